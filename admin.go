@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"device-analytics/breaker"
+	"device-analytics/configuration"
+	"device-analytics/logic"
+
+	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
+	"github.com/gocql/gocql"
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ReadyzHandler is the HTTP handler for readiness probes. The service is ready once
+// Cassandra answers queries. With a circuit breaker, the service is not ready while it is
+// open, and readiness checks probe for recovery once it half-opens.
+type ReadyzHandler struct {
+	logger  *logger.Logger
+	session *gocql.Session
+	config  *configuration.Config
+	breaker *breaker.Breaker
+}
+
+// Readyz represents the JSON object sent in the body of a `/readyz` response.
+type Readyz struct {
+	Status         string `json:"status"`
+	CircuitBreaker string `json:"circuit_breaker,omitempty"`
+}
+
+func (s *ReadyzHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	c, cancel := context.WithTimeout(ctx, time.Duration(s.config.ContextTimeout)*time.Millisecond)
+	defer cancel()
+
+	if s.breaker != nil {
+		if err := s.breaker.Allow(time.Now()); err != nil {
+			logic.QueryProblem(ctx, err, s.logger)
+			return
+		}
+	}
+
+	var release string
+	err := s.session.Query(`SELECT release_version FROM system.local`).WithContext(c).Scan(&release)
+	if s.breaker != nil && logic.BreakerCounts(c, err) {
+		s.breaker.Record(time.Now(), err != nil)
+	}
+	if err != nil {
+		s.logger.Log(logger.WARNING, "Readiness check failed: %s", err)
+		problemResp := aqsassist.CreateProblem(http.StatusServiceUnavailable, "Cassandra is unavailable: "+err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusServiceUnavailable)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	readyz := Readyz{Status: "ready"}
+	if s.breaker != nil {
+		readyz.CircuitBreaker = s.breaker.State().String()
+	}
+	data, _ := marshalJSON(ctx, readyz)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(data)
+}
+
+// BuildInfoHandler is the HTTP handler for build and runtime information.
+type BuildInfoHandler struct {
+	started time.Time
+}
+
+func (s *BuildInfoHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	data, err := marshalJSON(ctx, NewBuildInfo(version, buildDate, buildHost, s.started))
+	if err != nil {
+		problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetBody(problemResp)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(data)
+}
+
+// ConfigHandler is the HTTP handler that dumps the effective configuration (including
+// defaults, but not secrets) as YAML. It is only served on the admin listener.
+type ConfigHandler struct {
+	config *configuration.Config
+}
+
+func (s *ConfigHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	redacted := *s.config
+	if redacted.CursorSecret != "" {
+		redacted.CursorSecret = "<redacted>"
+	}
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetBody(problemResp)
+		return
+	}
+	ctx.SetContentType("text/yaml; charset=utf-8")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(data)
+}
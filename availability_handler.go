@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"device-analytics/configuration"
+	"device-analytics/logic"
+
+	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
+	"github.com/gocql/gocql"
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+)
+
+// AvailabilityHandler is the HTTP handler for unique-devices availability requests.
+type AvailabilityHandler struct {
+	logger  *logger.Logger
+	session *gocql.Session
+	logic   *logic.AvailabilityLogic
+	config  *configuration.Config
+}
+
+// API documentation
+// @summary      Get the range of unique devices data available for a project
+// @router       /unique-devices/{project}/{access-site}/{granularity}/availability  [get]
+// @description  Given a Wikimedia project, access method and granularity, returns the earliest and latest available timestamps, and any gaps between them.
+// @param        project      path  string  true  "Domain of a Wikimedia project"  example(en.wikipedia.org)
+// @param        access-site  path  string  true  "Method of access"               example(all-sites)  Enums(all-sites, desktop-site, mobile-site)
+// @param        granularity  path  string  true  "Time unit for response data"    example(daily)  Enums(daily, monthly)
+// @produce      json
+// @success      200  {object}  entities.AvailabilityResponse
+func (s *AvailabilityHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	var err error
+
+	project := aqsassist.TrimProjectDomain(ctx.UserValue("project").(string))
+	accessSite := strings.ToLower(ctx.UserValue("access-site").(string))
+	granularity := strings.ToLower(ctx.UserValue("granularity").(string))
+
+	if granularity != "daily" && granularity != "monthly" && granularity != "hourly" {
+		problemResp := aqsassist.CreateProblem(http.StatusBadRequest, "Invalid granularity", string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	// Availability is found by reading the whole partition, so it has a longer timeout
+	c, cancel := requestContext(ctx, ctx, s.config, time.Duration(s.config.AvailabilityTimeout)*time.Millisecond)
+	defer cancel()
+	pbm, response := s.logic.ProcessAvailabilityLogic(c, ctx, project, accessSite, granularity, s.session, s.logger)
+	if pbm != nil {
+		problemResp, _ := json.Marshal(pbm)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	var data []byte
+	if data, err = marshalJSON(ctx, response); err != nil {
+		s.logger.Log(logger.ERROR, "Unable to marshal response object: %s", err)
+		problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(data)
+}
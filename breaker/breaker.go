@@ -0,0 +1,181 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	stateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "device_analytics_circuit_breaker_state",
+		Help: "State of circuit breakers, by breaker (0 closed, 1 half-open, 2 open).",
+	}, []string{"breaker"})
+	rejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "device_analytics_circuit_breaker_rejections_total",
+		Help: "Number of requests failed fast by circuit breakers, by breaker.",
+	}, []string{"breaker"})
+)
+
+func init() {
+	prometheus.MustRegister(stateGauge, rejections)
+}
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	Closed   State = iota // Requests are allowed, and their outcomes recorded
+	HalfOpen              // A probe request is allowed, to test for recovery
+	Open                  // Requests are rejected
+)
+
+func (s State) String() string {
+	switch s {
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	}
+	return "closed"
+}
+
+// OpenError is returned by Allow when a request is rejected.
+type OpenError struct {
+	RetryAfter time.Duration // Time until the breaker lets a probe request through
+}
+
+func (e *OpenError) Error() string {
+	return "circuit breaker is open"
+}
+
+// Settings configure a Breaker.
+type Settings struct {
+	Window      time.Duration // Period over which the error rate is measured
+	MinRequests int           // Requests needed in the window before the breaker opens
+	ErrorRate   float64       // Proportion of failed requests (0 to 1) that opens the breaker
+	OpenFor     time.Duration // Time spent open before a probe request is let through
+}
+
+// The window is divided into this many buckets, which expire one at a time.
+const buckets = 10
+
+// Breaker is a circuit breaker. It opens once the error rate over a sliding window reaches
+// a threshold, and rejects requests while open. After a while it half-opens, letting a
+// single probe request through: the breaker closes if the probe succeeds, and opens again
+// if it fails.
+type Breaker struct {
+	settings Settings
+	width    time.Duration // of a bucket
+
+	mu      sync.Mutex
+	state   State
+	until   time.Time // end of the open period, or of the probe when half-open
+	buckets [buckets]bucket
+
+	gauge     prometheus.Gauge
+	rejection prometheus.Counter
+}
+
+type bucket struct {
+	epoch    int64 // index of the period covered, since the Unix epoch
+	requests int
+	failures int
+}
+
+// New returns a closed Breaker. The name identifies the breaker in metrics.
+func New(name string, settings Settings) *Breaker {
+	b := &Breaker{
+		settings:  settings,
+		width:     settings.Window / buckets,
+		gauge:     stateGauge.WithLabelValues(name),
+		rejection: rejections.WithLabelValues(name),
+	}
+	if b.width <= 0 {
+		b.width = 1
+	}
+	b.gauge.Set(float64(Closed))
+	return b
+}
+
+// Allow reports whether a request may proceed at time now, returning an *OpenError if not.
+// Every request allowed should have its outcome recorded with Record.
+func (b *Breaker) Allow(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Closed {
+		return nil
+	}
+	if now.Before(b.until) {
+		b.rejection.Inc()
+		return &OpenError{RetryAfter: b.until.Sub(now)}
+	}
+
+	// Let a probe through. Should its outcome never be recorded, another probe is let
+	// through once the breaker would have opened again.
+	b.setState(HalfOpen)
+	b.until = now.Add(b.settings.OpenFor)
+	return nil
+}
+
+// Record records the outcome of a request at time now.
+func (b *Breaker) Record(now time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		// Requests allowed before the breaker opened tell nothing new
+		return
+	case HalfOpen:
+		if failed {
+			b.open(now)
+		} else {
+			b.buckets = [buckets]bucket{}
+			b.setState(Closed)
+		}
+		return
+	}
+
+	epoch := now.UnixNano() / int64(b.width)
+	current := &b.buckets[epoch%buckets]
+	if current.epoch != epoch {
+		*current = bucket{epoch: epoch}
+	}
+	current.requests++
+	if failed {
+		current.failures++
+	}
+
+	var requests, failures int
+	for _, bucket := range b.buckets {
+		if bucket.epoch > epoch-buckets {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	if requests >= b.settings.MinRequests && float64(failures) >= b.settings.ErrorRate*float64(requests) {
+		b.open(now)
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Must be called with mu held.
+func (b *Breaker) open(now time.Time) {
+	b.setState(Open)
+	b.until = now.Add(b.settings.OpenFor)
+}
+
+// Must be called with mu held.
+func (b *Breaker) setState(state State) {
+	b.state = state
+	b.gauge.Set(float64(state))
+}
@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "device_analytics_cache_requests_total",
+	Help: "Number of cache lookups, by cache and result (hit, miss, coalesced, stale or bypassed).",
+}, []string{"cache", "result"})
+
+func init() {
+	prometheus.MustRegister(requests)
+}
+
+// Cache is a bounded, in-memory LRU cache whose entries expire after a fixed TTL.
+// Concurrent misses for the same key are coalesced, so that only one of them loads the
+// value while the others wait for its result.
+type Cache struct {
+	capacity int
+	ttl      time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently used at the front
+	calls   map[string]*call
+
+	hits, misses, coalesced, stale, bypassed prometheus.Counter
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// An in-flight load, shared by every caller that missed on the same key.
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// New returns a Cache of at most capacity entries, each valid for ttl, and loaded with a
+// timeout of timeout. The name identifies the cache in metrics.
+func New(name string, capacity int, ttl, timeout time.Duration) *Cache {
+	return &Cache{
+		capacity:  capacity,
+		ttl:       ttl,
+		timeout:   timeout,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		calls:     make(map[string]*call),
+		hits:      requests.WithLabelValues(name, "hit"),
+		misses:    requests.WithLabelValues(name, "miss"),
+		coalesced: requests.WithLabelValues(name, "coalesced"),
+		stale:     requests.WithLabelValues(name, "stale"),
+		bypassed:  requests.WithLabelValues(name, "bypassed"),
+	}
+}
+
+type bypassKey struct{}
+
+// Bypass marks ctx so that Get neither reads nor fills the cache for it, but calls load
+// directly under ctx. This lets a caller's own deadline reach the load, which a shared
+// load doesn't inherit.
+func Bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+// Get returns the value cached for key, calling load to obtain it on a miss. Values are
+// only cached when load succeeds; expired values are kept until they are replaced or
+// evicted, so that they can still be read with GetStale should load fail.
+//
+// The load runs under a context of its own, bounded by the cache's timeout rather than by
+// any one caller, so that callers coalesced on it don't inherit the deadline of the first.
+// Each caller waits for the result until its own ctx is done, and the result is cached
+// even if none of them waited for it. Callers whose ctx is marked with Bypass load the value
+// themselves instead.
+func (c *Cache) Get(ctx context.Context, key string, load func(context.Context) (interface{}, error)) (interface{}, error) {
+	if bypass, _ := ctx.Value(bypassKey{}).(bool); bypass {
+		c.bypassed.Inc()
+		return load(ctx)
+	}
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		e := element.Value.(*entry)
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(element)
+			c.mu.Unlock()
+			c.hits.Inc()
+			return e.value, nil
+		}
+	}
+	pending, ok := c.calls[key]
+	if ok {
+		c.coalesced.Inc()
+	} else {
+		pending = &call{done: make(chan struct{})}
+		c.calls[key] = pending
+		c.misses.Inc()
+		go c.load(key, pending, load)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-pending.done:
+		return pending.value, pending.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// load runs a load for key, and caches its value if it succeeds.
+func (c *Cache) load(key string, pending *call, load func(context.Context) (interface{}, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	pending.value, pending.err = load(ctx)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if pending.err == nil {
+		c.add(key, pending.value)
+	}
+	c.mu.Unlock()
+	close(pending.done)
+}
+
+// GetStale returns the value cached for key, even if it has expired, without loading it
+// on a miss. The boolean result reports whether there was a value.
+func (c *Cache) GetStale(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.stale.Inc()
+	return element.Value.(*entry).value, true
+}
+
+// Purge removes every entry whose key begins with prefix (every entry, if prefix is
+// empty), and returns the number removed.
+func (c *Cache) Purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var purged int
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(element)
+			purged++
+		}
+	}
+	return purged
+}
+
+// Len returns the number of entries in the cache, including any that have expired but
+// not yet been evicted.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Must be called with mu held.
+func (c *Cache) add(key string, value interface{}) {
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&entry{key: key, value: value, expires: time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Must be called with mu held.
+func (c *Cache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*entry).key)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"device-analytics/configuration"
+	"device-analytics/entities"
+	"device-analytics/logic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// setCacheControl sets the Cache-Control header of a unique-devices response for a range
+// ending at end. Ranges entirely in the past, and for which data has been loaded, will
+// never change, and so are cacheable for a long time; anything touching the current period
+// (or not yet loaded) is only briefly cacheable. So are ranges requested with a relative
+// start or end, since the same URI names a different range from one day to the next.
+func setCacheControl(ctx *fasthttp.RequestCtx, config *configuration.Config, granularity, end string, relative bool, items []entities.UniqueDevices) {
+	if !relative && immutableRange(granularity, end, items, time.Now()) {
+		ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", config.CacheControl.Policy(granularity).PastMaxAge))
+		return
+	}
+	setCurrentCacheControl(ctx, config, granularity)
+}
+
+// setCurrentCacheControl sets the Cache-Control header of a response that may change when
+// new data for granularity is loaded.
+func setCurrentCacheControl(ctx *fasthttp.RequestCtx, config *configuration.Config, granularity string) {
+	ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.CacheControl.Policy(granularity).CurrentMaxAge))
+}
+
+// setNotFoundCacheControl sets the Cache-Control header of a 404 response; data may be
+// loaded at any time, so these are only briefly cacheable.
+func setNotFoundCacheControl(ctx *fasthttp.RequestCtx, config *configuration.Config) {
+	ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.CacheControl.NotFoundMaxAge))
+}
+
+// immutableRange reports whether the period containing end is over, and items (sorted by
+// timestamp) include data for it.
+func immutableRange(granularity, end string, items []entities.UniqueDevices, now time.Time) bool {
+	if len(items) == 0 {
+		return false
+	}
+	periodStart, periodEnd, err := logic.PeriodContaining(end, granularity)
+	if err != nil || periodEnd.After(now) {
+		return false
+	}
+	latest, err := logic.ParseTimestamp(items[len(items)-1].Timestamp)
+	if err != nil {
+		return false
+	}
+	return !latest.Before(periodStart)
+}
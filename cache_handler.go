@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+
+	"device-analytics/cache"
+
+	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+)
+
+// CacheHandler is the HTTP handler for purging the response cache. It is only served on
+// the admin listener.
+type CacheHandler struct {
+	logger *logger.Logger
+	cache  *cache.Cache
+}
+
+// PurgeResponse represents the JSON object sent in the body of a cache purge response.
+type PurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// HandleFastHTTP purges cached responses; those for one project if the project query
+// parameter is given, or every one otherwise.
+func (s *CacheHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	var prefix string
+	if project := string(ctx.QueryArgs().Peek("project")); project != "" {
+		prefix = aqsassist.TrimProjectDomain(project) + "/"
+	}
+
+	purged := s.cache.Purge(prefix)
+	s.logger.Log(logger.INFO, "Purged %d cached response(s) matching '%s'", purged, prefix)
+
+	data, err := marshalJSON(ctx, PurgeResponse{Purged: purged})
+	if err != nil {
+		problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(data)
+}
@@ -18,7 +18,11 @@ package main
 import (
 	"fmt"
 	"strings"
-	"unique-devices/configuration"
+	"time"
+
+	"device-analytics/breaker"
+	"device-analytics/configuration"
+	"device-analytics/logic"
 
 	"github.com/gocql/gocql"
 )
@@ -40,6 +44,34 @@ func newCassandraSession(config *configuration.Config) (*gocql.Session, error) {
 	return cluster.CreateSession()
 }
 
+// Return the speculative execution and retry policies corresponding to the provided config.
+func queryPolicies(config *configuration.Config) logic.QueryPolicies {
+	var policies logic.QueryPolicies
+
+	if s := config.Cassandra.SpeculativeExecution; s.Attempts > 0 {
+		policies.Speculative = &gocql.SimpleSpeculativeExecution{
+			NumAttempts:  s.Attempts,
+			TimeoutDelay: time.Duration(s.Delay) * time.Millisecond,
+		}
+	}
+	if r := config.Cassandra.Retry; r.NumRetries > 0 {
+		policies.Retry = &logic.BackoffRetryPolicy{
+			NumRetries: r.NumRetries,
+			Min:        time.Duration(r.MinBackoff) * time.Millisecond,
+			Max:        time.Duration(r.MaxBackoff) * time.Millisecond,
+		}
+	}
+	if b := config.Cassandra.CircuitBreaker; b.Enabled {
+		policies.Breaker = breaker.New("cassandra", breaker.Settings{
+			Window:      time.Duration(b.Window) * time.Second,
+			MinRequests: b.MinRequests,
+			ErrorRate:   b.ErrorRate,
+			OpenFor:     time.Duration(b.OpenDuration) * time.Second,
+		})
+	}
+	return policies
+}
+
 // Given a string, return the corresponding GoCQL consistency level type.
 func goCQLConsistency(c string) (gocql.Consistency, error) {
 	switch strings.ToLower(c) {
@@ -0,0 +1,100 @@
+package certreload
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
+)
+
+// Reloader serves a TLS certificate and key pair loaded from files, and loads them again
+// when either file changes, so that certificates can be rotated without a restart.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+// New returns a Reloader for the given certificate and key files, which must be loadable.
+func New(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.certificate, nil
+}
+
+// Reload loads the certificate and key again if either file has been modified since they
+// were last loaded, and reports whether it did. On failure, the current certificate is
+// kept.
+func (r *Reloader) Reload() (bool, error) {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.certificate != nil && !modTime.After(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	r.certificate = &certificate
+	r.modTime = modTime
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Run checks for changes every interval until context is done.
+func (r *Reloader) Run(context context.Context, interval time.Duration, rLogger *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-context.Done():
+			return
+		case <-ticker.C:
+		}
+		if reloaded, err := r.Reload(); err != nil {
+			rLogger.Log(logger.ERROR, "Unable to reload TLS certificate %s: %s", r.certFile, err)
+		} else if reloaded {
+			rLogger.Log(logger.INFO, "Reloaded TLS certificate %s", r.certFile)
+		}
+	}
+}
+
+// latestModTime returns the most recent modification time of the given files.
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"device-analytics/configuration"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fasthttp"
+)
+
+// Supported content codings, in order of preference when the client accepts several
+// equally.
+var contentCodings = []string{"br", "zstd", "gzip"}
+
+// Content types worth compressing; anything else (e.g. images) is left as it is.
+var compressibleTypes = []string{"application/json", "application/problem+json", "application/x-ndjson", "text/"}
+
+// CompressMiddleware returns middleware that compresses response bodies of at least the
+// configured minimum size, using the best content coding the client accepts (brotli,
+// zstd or gzip). Streamed bodies are left uncompressed.
+func CompressMiddleware(config *configuration.Config) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
+	// A single encoder can be shared, as EncodeAll is safe for concurrent use
+	encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			next(ctx)
+
+			if !config.Compression.Enabled || ctx.Response.IsBodyStream() || !compressible(ctx.Response.Header.ContentType()) {
+				return
+			}
+			ctx.Response.Header.Add("Vary", "Accept-Encoding")
+
+			body := ctx.Response.Body()
+			if len(body) < config.Compression.MinSize || len(ctx.Response.Header.Peek("Content-Encoding")) > 0 {
+				return
+			}
+
+			var compressed []byte
+			switch negotiateCoding(string(ctx.Request.Header.Peek("Accept-Encoding"))) {
+			case "br":
+				compressed = fasthttp.AppendBrotliBytesLevel(nil, body, fasthttp.CompressBrotliDefaultCompression)
+				ctx.Response.Header.Set("Content-Encoding", "br")
+			case "zstd":
+				compressed = encoder.EncodeAll(body, nil)
+				ctx.Response.Header.Set("Content-Encoding", "zstd")
+			case "gzip":
+				compressed = fasthttp.AppendGzipBytesLevel(nil, body, fasthttp.CompressDefaultCompression)
+				ctx.Response.Header.Set("Content-Encoding", "gzip")
+			default:
+				return
+			}
+			ctx.Response.SetBodyRaw(compressed)
+
+			// The compressed body is no longer byte-for-byte identical to the one the
+			// strong ETag (if any) describes
+			if etag := ctx.Response.Header.Peek("ETag"); len(etag) > 0 && !bytes.HasPrefix(etag, []byte("W/")) {
+				ctx.Response.Header.Set("ETag", "W/"+string(etag))
+			}
+		}
+	}
+}
+
+// negotiateCoding returns the supported content coding with the highest quality value
+// in an Accept-Encoding header, or an empty string if none is acceptable.
+func negotiateCoding(header string) string {
+	qualities := make(map[string]float64)
+	for _, accepted := range parseAccept(header) {
+		qualities[accepted.value] = accepted.quality
+	}
+
+	coding, quality := "", 0.0
+	for _, candidate := range contentCodings {
+		q, ok := qualities[candidate]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > quality {
+			coding, quality = candidate, q
+		}
+	}
+	return coding
+}
+
+func compressible(contentType []byte) bool {
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(strings.ToLower(string(contentType)), t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"device-analytics/entities"
+	"device-analytics/logic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ConditionalGetMiddleware adds a strong ETag, computed from the body, to successful GET
+// and HEAD responses that don't already have one, and answers conditional requests
+// (If-None-Match, or If-Modified-Since with the Last-Modified set by the handler) with
+// 304 Not Modified. Streamed bodies are left alone.
+func ConditionalGetMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		next(ctx)
+
+		if !(ctx.IsGet() || ctx.IsHead()) || ctx.Response.StatusCode() != fasthttp.StatusOK || ctx.Response.IsBodyStream() {
+			return
+		}
+
+		etag := string(ctx.Response.Header.Peek("ETag"))
+		if etag == "" {
+			sum := sha256.Sum256(ctx.Response.Body())
+			etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+			ctx.Response.Header.Set("ETag", etag)
+		}
+
+		if notModified(ctx, etag) {
+			ctx.SetStatusCode(fasthttp.StatusNotModified)
+			ctx.ResetBody()
+		}
+	}
+}
+
+// notModified reports whether a request's preconditions show that the client already
+// has the current representation. If-None-Match takes precedence over If-Modified-Since.
+func notModified(ctx *fasthttp.RequestCtx, etag string) bool {
+	if ifNoneMatch := ctx.Request.Header.Peek("If-None-Match"); len(ifNoneMatch) > 0 {
+		return etagMatches(string(ifNoneMatch), etag)
+	}
+
+	ifModifiedSince, err := fasthttp.ParseHTTPDate(ctx.Request.Header.Peek("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := fasthttp.ParseHTTPDate(ctx.Response.Header.Peek("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifModifiedSince)
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag, using the
+// weak comparison required for conditional GET requests.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// setLastModified sets Last-Modified from the timestamp of the latest row in items.
+func setLastModified(ctx *fasthttp.RequestCtx, items []entities.UniqueDevices) {
+	var latest string
+	for _, item := range items {
+		if item.Timestamp > latest {
+			latest = item.Timestamp
+		}
+	}
+	if t, err := logic.ParseTimestamp(latest); err == nil {
+		ctx.Response.Header.SetLastModified(t)
+	}
+}
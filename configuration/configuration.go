@@ -17,8 +17,12 @@
 package configuration
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 
 	yaml "gopkg.in/yaml.v2"
@@ -26,36 +30,356 @@ import (
 
 // Config represents an application-wide configuration.
 type Config struct {
-	ServiceName    string    `yaml:"service_name"`
-	BaseURI        string    `yaml:"base_uri"`
-	Address        string    `yaml:"listen_address"`
-	Port           int       `yaml:"listen_port"`
-	LogLevel       string    `yaml:"log_level"`
-	ContextTimeout int       `yaml:"context_timeout"`
-	Cassandra      cassandra `yaml:"cassandra"`
+	ServiceName             string          `yaml:"service_name"`
+	BaseURI                 string          `yaml:"base_uri"`
+	Address                 string          `yaml:"listen_address"`
+	Port                    int             `yaml:"listen_port"`
+	SocketMode              string          `yaml:"socket_mode"`
+	TLS                     tlsSettings     `yaml:"tls"`
+	Server                  serverSettings  `yaml:"server"`
+	LogLevel                string          `yaml:"log_level"`
+	Admin                   admin           `yaml:"admin"`
+	Pprof                   pprof           `yaml:"pprof"`
+	ContextTimeout          int             `yaml:"context_timeout"`
+	DeadlineHeader          string          `yaml:"deadline_header"`
+	StreamTimeout           int             `yaml:"stream_timeout"`
+	CursorSecret            string          `yaml:"cursor_secret"`
+	AvailabilityCacheTTL    int             `yaml:"availability_cache_ttl"`
+	AvailabilityCacheSize   int             `yaml:"availability_cache_size"`
+	AvailabilityTimeout     int             `yaml:"availability_timeout"`
+	ProjectsRefreshInterval int             `yaml:"projects_refresh_interval"`
+	Compression             compression     `yaml:"compression"`
+	CacheControl            cacheControl    `yaml:"cache_control"`
+	ResponseCache           responseCache   `yaml:"response_cache"`
+	RateLimit               rateLimit       `yaml:"rate_limit"`
+	RangeLimits             rangeLimits     `yaml:"range_limits"`
+	CORS                    cors            `yaml:"cors"`
+	SecurityHeaders         securityHeaders `yaml:"security_headers"`
+	Cassandra               cassandra       `yaml:"cassandra"`
+}
+
+// ListenAddress returns the address to listen on: either host:port, or listen_address
+// itself if it names a Unix domain socket (unix:/path) or systemd socket (systemd[:N]).
+func (c *Config) ListenAddress() string {
+	return listenAddress(c.Address, c.Port)
+}
+
+// SocketFileMode returns the permissions of Unix domain sockets.
+func (c *Config) SocketFileMode() os.FileMode {
+	mode, _ := strconv.ParseUint(c.SocketMode, 8, 32)
+	return os.FileMode(mode)
+}
+
+func listenAddress(address string, port int) string {
+	if isSocket(address) {
+		return address
+	}
+	return net.JoinHostPort(address, strconv.Itoa(port))
+}
+
+// isSocket reports whether address names a Unix domain socket or systemd socket, rather
+// than an IP interface.
+func isSocket(address string) bool {
+	return strings.HasPrefix(address, "unix:") || strings.HasPrefix(address, "systemd")
+}
+
+// serverSettings tunes the HTTP servers; timeouts are in milliseconds, and 0 means no limit
+// (or the fasthttp default, for Concurrency, MaxRequestBodySize and ReadBufferSize).
+type serverSettings struct {
+	Name               string `yaml:"name"`
+	ReadTimeout        int    `yaml:"read_timeout"`
+	WriteTimeout       int    `yaml:"write_timeout"`
+	IdleTimeout        int    `yaml:"idle_timeout"`
+	Concurrency        int    `yaml:"concurrency"`
+	MaxConnsPerIP      int    `yaml:"max_conns_per_ip"`
+	MaxRequestsPerConn int    `yaml:"max_requests_per_conn"`
+	MaxRequestBodySize int    `yaml:"max_request_body_size"`
+	ReadBufferSize     int    `yaml:"read_buffer_size"`
+	ReduceMemoryUsage  bool   `yaml:"reduce_memory_usage"`
+}
+
+type admin struct {
+	Address string `yaml:"listen_address"`
+	Port    int    `yaml:"listen_port"`
+}
+
+// ListenAddress returns the address of the admin listener (see Config.ListenAddress).
+func (a admin) ListenAddress() string {
+	return listenAddress(a.Address, a.Port)
+}
+
+// Enabled reports whether operational endpoints are served on a separate admin listener:
+// when it has a port, or listens on a socket, which needs none.
+func (a admin) Enabled() bool {
+	return a.Port > 0 || isSocket(a.Address)
+}
+
+type pprof struct {
+	Enabled              bool `yaml:"enabled"`
+	MaxProfileSeconds    int  `yaml:"max_profile_seconds"`
+	MutexProfileFraction int  `yaml:"mutex_profile_fraction"`
+	BlockProfileRate     int  `yaml:"block_profile_rate"`
+}
+
+type tlsSettings struct {
+	Cert           string `yaml:"cert"`
+	Key            string `yaml:"key"`
+	ClientCA       string `yaml:"client_ca"`
+	MinVersion     string `yaml:"min_version"`
+	ReloadInterval int    `yaml:"reload_interval"`
+}
+
+// Enabled reports whether the service should serve HTTPS.
+func (t tlsSettings) Enabled() bool {
+	return t.Cert != "" && t.Key != ""
+}
+
+// Version returns the minimum TLS version, as a crypto/tls version constant.
+func (t tlsSettings) Version() (uint16, error) {
+	switch t.MinVersion {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Unsupported TLS version: %s", t.MinVersion)
+}
+
+type compression struct {
+	Enabled bool `yaml:"enabled"`
+	MinSize int  `yaml:"min_size"`
+}
+
+type responseCache struct {
+	Enabled bool `yaml:"enabled"`
+	Size    int  `yaml:"size"`
+	TTL     int  `yaml:"ttl"`
+}
+
+type rateLimit struct {
+	Enabled        bool     `yaml:"enabled"`
+	Rate           float64  `yaml:"rate"`
+	Burst          int      `yaml:"burst"`
+	ClientHeader   string   `yaml:"client_header"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	AllowedIPs     []string `yaml:"allowed_ips"`
+	AllowedClients []string `yaml:"allowed_clients"`
+}
+
+type cors struct {
+	Enabled        bool     `yaml:"enabled"`
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	AllowedMethods []string `yaml:"allowed_methods"`
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	ExposedHeaders []string `yaml:"exposed_headers"`
+	MaxAge         int      `yaml:"max_age"`
+}
+
+type securityHeaders struct {
+	ContentSecurityPolicy     string `yaml:"content_security_policy"`
+	FrameOptions              string `yaml:"frame_options"`
+	ReferrerPolicy            string `yaml:"referrer_policy"`
+	CrossOriginResourcePolicy string `yaml:"cross_origin_resource_policy"`
+	HSTSMaxAge                int    `yaml:"hsts_max_age"`
+	HSTSIncludeSubdomains     bool   `yaml:"hsts_include_subdomains"`
+}
+
+type rangeLimits struct {
+	Paginate     bool `yaml:"paginate"`
+	periodLimits `yaml:",inline"`
+	AccessSites  map[string]periodLimits `yaml:"access_sites"`
+}
+
+// periodLimits is the maximum number of periods a range may touch, per granularity (0 for
+// no limit).
+type periodLimits struct {
+	Hourly  int `yaml:"hourly"`
+	Daily   int `yaml:"daily"`
+	Monthly int `yaml:"monthly"`
+}
+
+func (l periodLimits) limit(granularity string) int {
+	switch granularity {
+	case "hourly":
+		return l.Hourly
+	case "monthly":
+		return l.Monthly
+	}
+	return l.Daily
+}
+
+// Limit returns the maximum number of periods a range of granularity may touch for
+// accessSite, or 0 if there is no limit. Limits for an access site override the default.
+func (r rangeLimits) Limit(accessSite, granularity string) int {
+	if limit := r.AccessSites[accessSite].limit(granularity); limit > 0 {
+		return limit
+	}
+	return r.periodLimits.limit(granularity)
+}
+
+type cacheControl struct {
+	NotFoundMaxAge int         `yaml:"not_found_max_age"`
+	Hourly         cachePolicy `yaml:"hourly"`
+	Daily          cachePolicy `yaml:"daily"`
+	Monthly        cachePolicy `yaml:"monthly"`
+}
+
+// cachePolicy is the Cache-Control max-age, in seconds, for ranges of one granularity that
+// are entirely in the past (and loaded), and for those touching the current period.
+type cachePolicy struct {
+	PastMaxAge    int `yaml:"past_max_age"`
+	CurrentMaxAge int `yaml:"current_max_age"`
+}
+
+// Policy returns the cache policy for a granularity.
+func (c cacheControl) Policy(granularity string) cachePolicy {
+	switch granularity {
+	case "hourly":
+		return c.Hourly
+	case "monthly":
+		return c.Monthly
+	}
+	return c.Daily
 }
 
 type cassandra struct {
-	Port        int      `yaml:"port"`
-	Consistency string   `yaml:"consistency"`
-	Hosts       []string `yaml:"hosts"`
-	LocalDC     string   `yaml:"local_dc"`
+	Port                 int                  `yaml:"port"`
+	Consistency          string               `yaml:"consistency"`
+	Hosts                []string             `yaml:"hosts"`
+	LocalDC              string               `yaml:"local_dc"`
+	SpeculativeExecution speculativeExecution `yaml:"speculative_execution"`
+	Retry                retry                `yaml:"retry"`
+	CircuitBreaker       circuitBreaker       `yaml:"circuit_breaker"`
+}
+
+// speculativeExecution is the number of additional executions of a query to start, one
+// every Delay milliseconds while it has not completed (0 attempts to disable).
+type speculativeExecution struct {
+	Attempts int `yaml:"attempts"`
+	Delay    int `yaml:"delay"`
+}
+
+// retry is the number of times to retry failed queries (0 to disable), and the bounds,
+// in milliseconds, of the exponential backoff between attempts.
+type retry struct {
+	NumRetries int `yaml:"num_retries"`
+	MinBackoff int `yaml:"min_backoff"`
+	MaxBackoff int `yaml:"max_backoff"`
+}
+
+// circuitBreaker fails queries fast once at least MinRequests were made in the last Window
+// seconds and at least ErrorRate (0 to 1) of them failed. It stays open for OpenDuration
+// seconds, then lets a single probe query through to test whether Cassandra recovered.
+// With ServeStale, expired response cache entries are served while it is open.
+type circuitBreaker struct {
+	Enabled      bool    `yaml:"enabled"`
+	Window       int     `yaml:"window"`
+	MinRequests  int     `yaml:"min_requests"`
+	ErrorRate    float64 `yaml:"error_rate"`
+	OpenDuration int     `yaml:"open_duration"`
+	ServeStale   bool    `yaml:"serve_stale"`
 }
 
 // NewConfig returns a new Config from YAML serialized as bytes.
 func NewConfig(data []byte) (*Config, error) {
 	// Populate a new Config with sane defaults
 	config := Config{
-		ServiceName:    "device-analytics",
-		BaseURI:        "/metrics/unique-devices",
-		Address:        "localhost",
-		Port:           8080,
-		LogLevel:       "info",
-		ContextTimeout: 40,
+		ServiceName:             "device-analytics",
+		BaseURI:                 "/metrics/unique-devices",
+		Address:                 "localhost",
+		Port:                    8080,
+		SocketMode:              "0660",
+		LogLevel:                "info",
+		ContextTimeout:          40,
+		DeadlineHeader:          "X-Request-Timeout",
+		StreamTimeout:           30000,
+		AvailabilityCacheTTL:    300,
+		AvailabilityCacheSize:   10000,
+		AvailabilityTimeout:     1000,
+		ProjectsRefreshInterval: 3600,
+		Server: serverSettings{
+			ReadTimeout:        10000,
+			WriteTimeout:       60000,
+			IdleTimeout:        60000,
+			MaxRequestBodySize: 1048576,
+			ReadBufferSize:     8192,
+		},
+		Admin: admin{
+			Address: "localhost",
+		},
+		Pprof: pprof{
+			Enabled:              false,
+			MaxProfileSeconds:    60,
+			MutexProfileFraction: 100,
+			BlockProfileRate:     10000000,
+		},
+		TLS: tlsSettings{
+			MinVersion:     "1.2",
+			ReloadInterval: 60,
+		},
+		Compression: compression{
+			Enabled: true,
+			MinSize: 1024,
+		},
+		CacheControl: cacheControl{
+			NotFoundMaxAge: 300,
+			Hourly:         cachePolicy{PastMaxAge: 31536000, CurrentMaxAge: 300},
+			Daily:          cachePolicy{PastMaxAge: 31536000, CurrentMaxAge: 3600},
+			Monthly:        cachePolicy{PastMaxAge: 31536000, CurrentMaxAge: 3600},
+		},
+		ResponseCache: responseCache{
+			Enabled: true,
+			Size:    10000,
+			TTL:     300,
+		},
+		RateLimit: rateLimit{
+			Enabled: false,
+			Rate:    10,
+			Burst:   50,
+		},
+		RangeLimits: rangeLimits{
+			Paginate: false,
+		},
+		CORS: cors{
+			Enabled:        false,
+			AllowedOrigins: []string{"*"},
+			AllowedMethods: []string{"GET", "OPTIONS"},
+			AllowedHeaders: []string{"Accept", "If-None-Match", "If-Modified-Since"},
+			ExposedHeaders: []string{"ETag", "Link", "Content-Disposition", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "X-Effective-Timeout"},
+			MaxAge:         86400,
+		},
+		SecurityHeaders: securityHeaders{
+			ContentSecurityPolicy:     "default-src 'none'; frame-ancestors 'none'",
+			FrameOptions:              "deny",
+			ReferrerPolicy:            "no-referrer",
+			CrossOriginResourcePolicy: "same-origin",
+			HSTSMaxAge:                31536000,
+		},
 		Cassandra: cassandra{
 			Port:        9042,
 			Consistency: "quorum",
 			Hosts:       []string{"localhost"},
+			SpeculativeExecution: speculativeExecution{
+				Attempts: 0,
+				Delay:    10,
+			},
+			Retry: retry{
+				NumRetries: 0,
+				MinBackoff: 2,
+				MaxBackoff: 10,
+			},
+			CircuitBreaker: circuitBreaker{
+				Enabled:      false,
+				Window:       10,
+				MinRequests:  20,
+				ErrorRate:    0.5,
+				OpenDuration: 5,
+				ServeStale:   false,
+			},
 		},
 	}
 	err := yaml.Unmarshal(data, &config)
@@ -92,6 +416,144 @@ func validateCassandraConsistency(c cassandra) error {
 	return fmt.Errorf("Unsupported consistency level: %s", c.Consistency)
 }
 
+// validatePprof ensures that profiling is only served on the admin listener, with a
+// usable maximum CPU profile duration
+func validatePprof(p pprof, a admin) error {
+	if !p.Enabled {
+		return nil
+	}
+	if !a.Enabled() {
+		return fmt.Errorf("pprof requires the admin listener")
+	}
+	if p.MaxProfileSeconds < 1 {
+		return fmt.Errorf("Invalid maximum profile duration: %d", p.MaxProfileSeconds)
+	}
+	return nil
+}
+
+// validateServer ensures server settings are not negative, and that the write timeout
+// leaves time to stream responses
+func validateServer(s serverSettings, streamTimeout int) error {
+	for name, value := range map[string]int{
+		"read timeout":          s.ReadTimeout,
+		"write timeout":         s.WriteTimeout,
+		"idle timeout":          s.IdleTimeout,
+		"concurrency":           s.Concurrency,
+		"max conns per IP":      s.MaxConnsPerIP,
+		"max requests per conn": s.MaxRequestsPerConn,
+		"max request body size": s.MaxRequestBodySize,
+		"read buffer size":      s.ReadBufferSize,
+	} {
+		if value < 0 {
+			return fmt.Errorf("Invalid server %s: %d", name, value)
+		}
+	}
+	if s.WriteTimeout > 0 && s.WriteTimeout < streamTimeout {
+		return fmt.Errorf("Server write timeout (%d) must not be shorter than the stream timeout (%d)", s.WriteTimeout, streamTimeout)
+	}
+	return nil
+}
+
+// validateTLS ensures that a certificate and key are configured together, and that mTLS
+// is only configured along with them
+func validateTLS(t tlsSettings) error {
+	if (t.Cert == "") != (t.Key == "") {
+		return fmt.Errorf("TLS requires both a certificate and a key")
+	}
+	if t.ClientCA != "" && !t.Enabled() {
+		return fmt.Errorf("TLS client verification requires a certificate and a key")
+	}
+	if _, err := t.Version(); err != nil {
+		return err
+	}
+	if t.Enabled() && t.ReloadInterval <= 0 {
+		return fmt.Errorf("Invalid TLS reload interval: %d", t.ReloadInterval)
+	}
+	return nil
+}
+
+// validateQueryPolicies ensures usable speculative execution and retry settings
+func validateQueryPolicies(c cassandra) error {
+	if s := c.SpeculativeExecution; s.Attempts < 0 || (s.Attempts > 0 && s.Delay <= 0) {
+		return fmt.Errorf("Invalid speculative execution: attempts %d, delay %d", s.Attempts, s.Delay)
+	}
+	if r := c.Retry; r.NumRetries < 0 || (r.NumRetries > 0 && (r.MinBackoff <= 0 || r.MaxBackoff < r.MinBackoff)) {
+		return fmt.Errorf("Invalid retry policy: retries %d, backoff %d to %d", r.NumRetries, r.MinBackoff, r.MaxBackoff)
+	}
+	return nil
+}
+
+// validateCircuitBreaker ensures usable circuit breaker settings, and a response cache to
+// serve stale responses from
+func validateCircuitBreaker(b circuitBreaker, r responseCache) error {
+	if !b.Enabled {
+		return nil
+	}
+	if b.Window <= 0 || b.MinRequests < 1 || b.ErrorRate <= 0 || b.ErrorRate > 1 || b.OpenDuration <= 0 {
+		return fmt.Errorf("Invalid circuit breaker: window %d, min requests %d, error rate %v, open duration %d", b.Window, b.MinRequests, b.ErrorRate, b.OpenDuration)
+	}
+	if b.ServeStale && !r.Enabled {
+		return fmt.Errorf("Serving stale responses requires the response cache")
+	}
+	return nil
+}
+
+// validateRateLimit ensures a usable rate limit, and well-formed allowed addresses
+func validateRateLimit(r rateLimit) error {
+	if !r.Enabled {
+		return nil
+	}
+	if r.Rate <= 0 || r.Burst < 1 {
+		return fmt.Errorf("Invalid rate limit: rate %v, burst %d", r.Rate, r.Burst)
+	}
+	for _, allowed := range r.AllowedIPs {
+		if net.ParseIP(allowed) == nil {
+			if _, _, err := net.ParseCIDR(allowed); err != nil {
+				return fmt.Errorf("Invalid allowed IP address or network: %s", allowed)
+			}
+		}
+	}
+	for _, proxy := range r.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("Invalid trusted proxy IP address or network: %s", proxy)
+			}
+		}
+	}
+	if r.ClientHeader != "" && len(r.TrustedProxies) == 0 {
+		return fmt.Errorf("The rate limit client header requires trusted proxies to set it")
+	}
+	return nil
+}
+
+// validateRangeLimits ensures range limits are not negative
+func validateRangeLimits(r rangeLimits) error {
+	limits := map[string]periodLimits{"default": r.periodLimits}
+	for accessSite, l := range r.AccessSites {
+		limits[accessSite] = l
+	}
+	for name, l := range limits {
+		if l.Hourly < 0 || l.Daily < 0 || l.Monthly < 0 {
+			return fmt.Errorf("Invalid range limits for %s: hourly %d, daily %d, monthly %d", name, l.Hourly, l.Daily, l.Monthly)
+		}
+	}
+	return nil
+}
+
+// validateCORS ensures at least one allowed origin, and a usable preflight max-age
+func validateCORS(c cors) error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("CORS is enabled, but no origins are allowed")
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("Invalid CORS max age: %d", c.MaxAge)
+	}
+	return nil
+}
+
 func validate(config *Config) (*Config, error) {
 	// Validate log level
 	if !strings.HasPrefix(config.BaseURI, "/") {
@@ -103,5 +565,47 @@ func validate(config *Config) (*Config, error) {
 	if err := validateCassandraConsistency(config.Cassandra); err != nil {
 		return nil, err
 	}
+	if err := validateQueryPolicies(config.Cassandra); err != nil {
+		return nil, err
+	}
+	if err := validateCircuitBreaker(config.Cassandra.CircuitBreaker, config.ResponseCache); err != nil {
+		return nil, err
+	}
+	if mode, err := strconv.ParseUint(config.SocketMode, 8, 32); err != nil || mode > 0777 {
+		return nil, fmt.Errorf("Invalid socket mode: %s", config.SocketMode)
+	}
+	if config.Admin.Enabled() && config.Admin.ListenAddress() == config.ListenAddress() {
+		return nil, fmt.Errorf("The admin listener must not use the service's address and port")
+	}
+	if err := validateServer(config.Server, config.StreamTimeout); err != nil {
+		return nil, err
+	}
+	if err := validatePprof(config.Pprof, config.Admin); err != nil {
+		return nil, err
+	}
+	if err := validateTLS(config.TLS); err != nil {
+		return nil, err
+	}
+	if config.ResponseCache.Enabled && config.ResponseCache.Size <= 0 {
+		return nil, fmt.Errorf("Invalid response cache size: %d", config.ResponseCache.Size)
+	}
+	if err := validateRateLimit(config.RateLimit); err != nil {
+		return nil, err
+	}
+	if err := validateRangeLimits(config.RangeLimits); err != nil {
+		return nil, err
+	}
+	if err := validateCORS(config.CORS); err != nil {
+		return nil, err
+	}
+	if config.SecurityHeaders.HSTSMaxAge < 0 {
+		return nil, fmt.Errorf("Invalid HSTS max age: %d", config.SecurityHeaders.HSTSMaxAge)
+	}
+	if config.AvailabilityCacheSize <= 0 || config.AvailabilityTimeout <= 0 {
+		return nil, fmt.Errorf("Invalid availability cache size %d or timeout %d", config.AvailabilityCacheSize, config.AvailabilityTimeout)
+	}
+	if config.ProjectsRefreshInterval <= 0 {
+		return nil, fmt.Errorf("Invalid projects refresh interval: %d", config.ProjectsRefreshInterval)
+	}
 	return config, nil
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"device-analytics/configuration"
+
+	"github.com/valyala/fasthttp"
+)
+
+// CORSMiddleware returns middleware that adds CORS headers to responses to requests from
+// allowed origins, and answers preflight requests itself with a 204 response.
+func CORSMiddleware(config *configuration.Config) func(ctx *fasthttp.RequestCtx) bool {
+	anyOrigin := false
+	allowedOrigins := make(map[string]bool)
+	for _, origin := range config.CORS.AllowedOrigins {
+		if origin == "*" {
+			anyOrigin = true
+		}
+		allowedOrigins[strings.ToLower(origin)] = true
+	}
+	allowedMethods := strings.Join(config.CORS.AllowedMethods, ", ")
+	allowedHeaders := strings.Join(config.CORS.AllowedHeaders, ", ")
+	exposedHeaders := strings.Join(config.CORS.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(config.CORS.MaxAge)
+
+	return func(ctx *fasthttp.RequestCtx) bool {
+		origin := string(ctx.Request.Header.Peek("Origin"))
+		if !anyOrigin {
+			// The response depends on the origin, unless every origin is allowed
+			ctx.Response.Header.Add("Vary", "Origin")
+		}
+		if origin == "" || !(anyOrigin || allowedOrigins[strings.ToLower(origin)]) {
+			return true
+		}
+
+		if anyOrigin {
+			ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if ctx.IsOptions() && len(ctx.Request.Header.Peek("Access-Control-Request-Method")) > 0 {
+			ctx.Response.Header.Set("Access-Control-Allow-Methods", allowedMethods)
+			if allowedHeaders != "" {
+				ctx.Response.Header.Set("Access-Control-Allow-Headers", allowedHeaders)
+			}
+			ctx.Response.Header.Set("Access-Control-Max-Age", maxAge)
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
+			return false
+		}
+
+		if exposedHeaders != "" {
+			ctx.Response.Header.Set("Access-Control-Expose-Headers", exposedHeaders)
+		}
+		return true
+	}
+}
+
+// OptionsHandler answers OPTIONS requests that are not CORS preflight requests, or are from
+// origins that are not allowed.
+func OptionsHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Header.Set("Allow", "GET, OPTIONS")
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
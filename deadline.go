@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"device-analytics/cache"
+	"device-analytics/configuration"
+	"device-analytics/logic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Response header reporting the timeout, in milliseconds, that a request's queries ran with
+const effectiveTimeoutHeader = "X-Effective-Timeout"
+
+// requestContext returns a context for the queries of a request, derived from parent and
+// bounded by maximum, or by the budget (in milliseconds) the client sent in the configured
+// deadline header, if that is smaller. Invalid budgets are ignored. The timeout is
+// reported in a response header. A context bounded by the client's budget is marked as
+// such (see logic.WithClientDeadline), and bypasses the caches, whose shared loads run
+// with timeouts of their own.
+func requestContext(parent context.Context, ctx *fasthttp.RequestCtx, config *configuration.Config, maximum time.Duration) (context.Context, context.CancelFunc) {
+	timeout := maximum
+	if config.DeadlineHeader != "" {
+		budget, err := strconv.Atoi(string(ctx.Request.Header.Peek(config.DeadlineHeader)))
+		if err == nil && budget > 0 && time.Duration(budget)*time.Millisecond < timeout {
+			timeout = time.Duration(budget) * time.Millisecond
+			parent = cache.Bypass(logic.WithClientDeadline(parent))
+		}
+	}
+	ctx.Response.Header.Set(effectiveTimeoutHeader, strconv.FormatInt(timeout.Milliseconds(), 10))
+	return context.WithTimeout(parent, timeout)
+}
@@ -0,0 +1,22 @@
+package entities
+
+// AvailabilityResponse represents a container for the data availability resultset.
+type AvailabilityResponse struct {
+	Items []Availability `json:"items"`
+}
+
+// Availability represents the range of unique devices data available for a project, access method and granularity.
+type Availability struct {
+	Project     string `json:"project" example:"en.wikipedia"`  // Wikimedia project domain
+	AccessSite  string `json:"access-site" example:"all-sites"` // Method of access
+	Granularity string `json:"granularity" example:"daily"`     // Frequency of data
+	Earliest    string `json:"earliest" example:"20150701"`     // First available timestamp in YYYYMMDD format
+	Latest      string `json:"latest" example:"20221031"`       // Last available timestamp in YYYYMMDD format
+	Gaps        []Gap  `json:"gaps"`                            // Missing periods between earliest and latest
+}
+
+// Gap represents a run of consecutive missing periods.
+type Gap struct {
+	Start string `json:"start" example:"20160101"` // First missing timestamp
+	End   string `json:"end" example:"20160103"`   // Last missing timestamp
+}
@@ -0,0 +1,21 @@
+package entities
+
+// ProjectsResponse represents a container for the project catalogue.
+type ProjectsResponse struct {
+	Items []Project `json:"items"`
+}
+
+// Project represents one project for which unique devices data is available.
+type Project struct {
+	Project  string              `json:"project" example:"en.wikipedia"`    // Project as stored and accepted by the API
+	Domain   string              `json:"domain" example:"en.wikipedia.org"` // Wikimedia project domain
+	Family   string              `json:"family" example:"wikipedia"`        // Project family
+	Language string              `json:"language,omitempty" example:"en"`   // Language code, for multilingual families
+	Coverage map[string]Coverage `json:"coverage"`                          // Available data, keyed by granularity
+}
+
+// Coverage represents the first and last timestamps available for a granularity, across all access methods.
+type Coverage struct {
+	Earliest string `json:"earliest" example:"20150701"` // First available timestamp in YYYYMMDD format
+	Latest   string `json:"latest" example:"20221031"`   // Last available timestamp in YYYYMMDD format
+}
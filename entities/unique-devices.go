@@ -2,7 +2,18 @@ package entities
 
 // UniqueDevicesResponse represents a container for the unique devices resultset.
 type UniqueDevicesResponse struct {
-	Items []UniqueDevices `json:"items"`
+	Items  []UniqueDevices `json:"items"`
+	Period string          `json:"period,omitempty" example:"P1D"` // ISO 8601 duration of one period (iso8601 time format only)
+	Range  *Range          `json:"range,omitempty"`                // Absolute range requested, when given as relative dates or in iso8601 time format
+	Next   string          `json:"next,omitempty"`                 // URL of the next page of results, when paginated
+}
+
+// Range represents the absolute date range a request was resolved to.
+type Range struct {
+	Start     string `json:"start" example:"2022010100"`                          // First date included
+	End       string `json:"end" example:"2022013100"`                            // Last date included
+	StartTime string `json:"start_time,omitempty" example:"2022-01-01T00:00:00Z"` // Start of the first period, in RFC 3339 format (iso8601 time format only)
+	EndTime   string `json:"end_time,omitempty" example:"2022-02-01T00:00:00Z"`   // End of the last period, in RFC 3339 format (iso8601 time format only)
 }
 
 // UniqueDevices represents one result from the unique devices resultset.
@@ -14,4 +25,6 @@ type UniqueDevices struct {
 	Devices       int    `json:"devices" example:"62614522"`         // Number of unique devices
 	Offset        int    `json:"offset" example:"13127765"`
 	Underestimate int    `json:"underestimate" example:"49486757"`
+	PeriodStart   string `json:"period_start,omitempty" example:"2022-01-01T00:00:00Z"` // Start of the period, in RFC 3339 format (iso8601 time format only)
+	PeriodEnd     string `json:"period_end,omitempty" example:"2022-01-02T00:00:00Z"`   // End of the period, in RFC 3339 format (iso8601 time format only)
 }
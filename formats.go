@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"device-analytics/entities"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Supported response formats
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatTSV    = "tsv"
+	formatNDJSON = "ndjson"
+)
+
+var formatContentTypes = map[string]string{
+	formatJSON:   "application/json; charset=utf-8",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatTSV:    "text/tab-separated-values; charset=utf-8",
+	formatNDJSON: "application/x-ndjson",
+}
+
+// Problem detail for a format parameter naming an unsupported format
+var invalidFormatDetail = func() string {
+	formats := make([]string, 0, len(formatContentTypes))
+	for format := range formatContentTypes {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	last := len(formats) - 1
+	return fmt.Sprintf("Invalid format, must be one of %s or %s", strings.Join(formats[:last], ", "), formats[last])
+}()
+
+var mediaTypeFormats = map[string]string{
+	"application/json":          formatJSON,
+	"application/*":             formatJSON,
+	"*/*":                       formatJSON,
+	"text/csv":                  formatCSV,
+	"text/tab-separated-values": formatTSV,
+	"application/x-ndjson":      formatNDJSON,
+}
+
+// Characters that are not safe to use in a Content-Disposition filename
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// negotiateFormat returns the format a unique-devices response should be rendered in. An
+// explicit format query parameter takes precedence over the Accept header; the boolean
+// result is false if the format parameter names an unsupported format. The response always
+// varies with the Accept header, which may also select time metadata (see isoTimeFormat).
+func negotiateFormat(ctx *fasthttp.RequestCtx) (string, bool) {
+	ctx.Response.Header.Add("Vary", "Accept")
+
+	if format := strings.ToLower(string(ctx.QueryArgs().Peek("format"))); format != "" {
+		_, ok := formatContentTypes[format]
+		return format, ok
+	}
+
+	// Choose the supported media type with the highest quality value, falling back to JSON
+	format, quality := formatJSON, 0.0
+	for _, accepted := range parseAccept(string(ctx.Request.Header.Peek("Accept"))) {
+		if candidate, ok := mediaTypeFormats[accepted.value]; ok && accepted.quality > quality {
+			format, quality = candidate, accepted.quality
+		}
+	}
+	return format, true
+}
+
+// acceptedValue is one element of an Accept-style header, with its quality value.
+type acceptedValue struct {
+	value   string
+	quality float64
+}
+
+// parseAccept parses an Accept-style header (e.g. Accept or Accept-Encoding) into its
+// values, lower-cased and stripped of parameters, in the order given.
+func parseAccept(header string) []acceptedValue {
+	var values []acceptedValue
+	for _, element := range strings.Split(header, ",") {
+		params := strings.Split(element, ";")
+		accepted := acceptedValue{value: strings.ToLower(strings.TrimSpace(params[0])), quality: 1.0}
+		if accepted.value == "" {
+			continue
+		}
+		for _, param := range params[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					accepted.quality = q
+				}
+			}
+		}
+		values = append(values, accepted)
+	}
+	return values
+}
+
+// marshalJSON returns the compact JSON encoding of v, or an indented encoding if the
+// request asked for it with the pretty query parameter.
+func marshalJSON(ctx *fasthttp.RequestCtx, v interface{}) ([]byte, error) {
+	switch strings.ToLower(string(ctx.QueryArgs().Peek("pretty"))) {
+	case "1", "true", "yes":
+		return json.MarshalIndent(v, "", " ")
+	}
+	return json.Marshal(v)
+}
+
+// writeDelimited writes response to the body as CSV or TSV, with a header line, and sets
+// the Content-Type and a Content-Disposition filename made from the name parts given.
+func writeDelimited(ctx *fasthttp.RequestCtx, format string, response entities.UniqueDevicesResponse, name ...string) error {
+	for i := range name {
+		name[i] = unsafeFilename.ReplaceAllString(name[i], "_")
+	}
+	ctx.SetContentType(formatContentTypes[format])
+	ctx.Response.Header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, strings.Join(name, "_"), format))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+
+	w := csv.NewWriter(ctx)
+	if format == formatTSV {
+		w.Comma = '\t'
+	}
+
+	// Period bounds are only included when requested (see isoTimeFormat)
+	periods := len(response.Items) > 0 && response.Items[0].PeriodStart != ""
+
+	header := []string{"project", "access-site", "granularity", "timestamp", "devices", "offset", "underestimate"}
+	if periods {
+		header = append(header, "period_start", "period_end")
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	for _, item := range response.Items {
+		record := []string{
+			item.Project,
+			item.AccessSite,
+			item.Granularity,
+			item.Timestamp,
+			strconv.Itoa(item.Devices),
+			strconv.Itoa(item.Offset),
+			strconv.Itoa(item.Underestimate),
+		}
+		if periods {
+			record = append(record, item.PeriodStart, item.PeriodEnd)
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
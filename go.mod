@@ -7,8 +7,8 @@ require (
 	github.com/carousell/fasthttp-prometheus-middleware v1.0.6
 	github.com/fasthttp/router v1.4.13
 	github.com/gocql/gocql v1.2.1
-	github.com/klauspost/compress v1.15.12 // indirect
-	github.com/prometheus/client_golang v1.14.0 // indirect
+	github.com/klauspost/compress v1.15.12
+	github.com/prometheus/client_golang v1.14.0
 	github.com/roger-russel/fasthttp-router-middleware v1.0.0
 	github.com/stretchr/testify v1.8.1
 	github.com/swaggo/swag v1.8.8 // indirect
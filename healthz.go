@@ -18,6 +18,7 @@ package main
 
 import (
 	"runtime"
+	"time"
 )
 
 // Healthz represents the JSON object sent in the body of a `/healthz` response.
@@ -37,3 +38,21 @@ func NewHealthz(version, date, host string) *Healthz {
 		GoVersion: runtime.Version(),
 	}
 }
+
+// BuildInfo represents the JSON object sent in the body of a `/admin/build-info` response.
+type BuildInfo struct {
+	Healthz
+	Platform string `json:"platform"`
+	Started  string `json:"started"`
+	Uptime   string `json:"uptime"`
+}
+
+// NewBuildInfo initializes and returns a new BuildInfo, for a service started at started.
+func NewBuildInfo(version, date, host string, started time.Time) *BuildInfo {
+	return &BuildInfo{
+		Healthz:  *NewHealthz(version, date, host),
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+		Started:  started.UTC().Format(time.RFC3339),
+		Uptime:   time.Since(started).Round(time.Second).String(),
+	}
+}
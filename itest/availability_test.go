@@ -0,0 +1,54 @@
+package itest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"device-analytics/entities"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvailability(t *testing.T) {
+	t.Run("should return 200 for expected parameters", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/availability"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err, "Unable to read response")
+
+		n := entities.AvailabilityResponse{}
+		err = json.Unmarshal(body, &n)
+		require.NoError(t, err, "Unable to unmarshal response body")
+
+		require.Len(t, n.Items, 1, "Unexpected response length")
+		assert.Equal(t, "en.wikipedia", n.Items[0].Project, "Wrong contents")
+		assert.NotEmpty(t, n.Items[0].Earliest, "Missing earliest timestamp")
+		assert.LessOrEqual(t, n.Items[0].Earliest, n.Items[0].Latest, "Earliest timestamp after latest")
+	})
+
+	t.Run("should return 400 when granularity is wrong", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/wrong-granularity/availability"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusBadRequest, res.StatusCode, "Wrong status code")
+	})
+
+	t.Run("should return 404 for a project without data", func(t *testing.T) {
+
+		res, err := http.Get(testURL("wrong-project/all-sites/daily/availability"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusNotFound, res.StatusCode, "Wrong status code")
+	})
+}
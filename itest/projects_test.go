@@ -0,0 +1,62 @@
+package itest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"device-analytics/entities"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProjects(t *testing.T) {
+	t.Run("should list projects with data", func(t *testing.T) {
+
+		res, err := http.Get(testURL("projects"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err, "Unable to read response")
+
+		n := entities.ProjectsResponse{}
+		err = json.Unmarshal(body, &n)
+		require.NoError(t, err, "Unable to unmarshal response body")
+
+		var found bool
+		for _, p := range n.Items {
+			if p.Project == "en.wikipedia" {
+				found = true
+				assert.Equal(t, "en.wikipedia.org", p.Domain, "Wrong domain")
+				assert.Equal(t, "wikipedia", p.Family, "Wrong family")
+				assert.Equal(t, "en", p.Language, "Wrong language")
+				assert.Contains(t, p.Coverage, "daily", "Missing daily coverage")
+			}
+		}
+		assert.True(t, found, "en.wikipedia missing from catalogue")
+	})
+
+	t.Run("should return 304 when the ETag matches", func(t *testing.T) {
+
+		res, err := http.Get(testURL("projects"))
+		require.NoError(t, err, "Invalid http request")
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+
+		etag := res.Header.Get("ETag")
+		require.NotEmpty(t, etag, "Missing ETag")
+
+		req, err := http.NewRequest(http.MethodGet, testURL("projects"), nil)
+		require.NoError(t, err, "Invalid http request")
+		req.Header.Set("If-None-Match", etag)
+
+		res, err = http.DefaultClient.Do(req)
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusNotModified, res.StatusCode, "Wrong status code")
+	})
+}
@@ -0,0 +1,103 @@
+package itest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// startService builds the service and starts it with the repository's configuration,
+// overridden by overrides, returning the running command.
+func startService(t *testing.T, overrides map[string]interface{}) *exec.Cmd {
+	dir, err := ioutil.TempDir("", "device-analytics")
+	require.NoError(t, err, "Unable to create a temporary directory")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	binary := filepath.Join(dir, "device-analytics")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Dir = ".."
+	output, err := build.CombinedOutput()
+	require.NoError(t, err, "Unable to build the service: %s", output)
+
+	data, err := ioutil.ReadFile("../config.yaml")
+	require.NoError(t, err, "Unable to read the configuration")
+	config := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal(data, &config), "Unable to parse the configuration")
+	for key, value := range overrides {
+		config[key] = value
+	}
+	data, err = yaml.Marshal(config)
+	require.NoError(t, err, "Unable to write the configuration")
+	configFile := filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configFile, data, 0600), "Unable to write the configuration")
+
+	cmd := exec.Command(binary, "-config", configFile)
+	require.NoError(t, cmd.Start(), "Unable to start the service")
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	return cmd
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	t.Run("should complete in-flight requests on SIGTERM", func(t *testing.T) {
+
+		cmd := startService(t, map[string]interface{}{
+			"listen_port": 18080,
+			"admin":       map[string]interface{}{"listen_address": "localhost", "listen_port": 18081},
+			"pprof":       map[string]interface{}{"enabled": true},
+		})
+
+		admin := "http://localhost:18081"
+		require.Eventually(t, func() bool {
+			res, err := http.Get(admin + "/healthz")
+			if err != nil {
+				return false
+			}
+			res.Body.Close()
+			return res.StatusCode == http.StatusOK
+		}, 30*time.Second, 100*time.Millisecond, "Service did not start")
+
+		// A CPU profile is a request that takes as long as we ask it to
+		type result struct {
+			status int
+			body   []byte
+			err    error
+		}
+		results := make(chan result, 1)
+		go func() {
+			res, err := http.Get(admin + "/debug/pprof/profile?seconds=3")
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			results <- result{status: res.StatusCode, body: body, err: err}
+		}()
+
+		time.Sleep(500 * time.Millisecond)
+		require.NoError(t, cmd.Process.Signal(syscall.SIGTERM), "Unable to signal the service")
+
+		r := <-results
+		require.NoError(t, r.err, "In-flight request failed")
+		assert.Equal(t, http.StatusOK, r.status, "Wrong status code")
+		assert.NotEmpty(t, r.body, "Empty profile")
+
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		select {
+		case err := <-exited:
+			assert.NoError(t, err, "Service did not exit cleanly")
+		case <-time.After(10 * time.Second):
+			t.Fatal("Service did not exit")
+		}
+	})
+}
@@ -10,6 +10,7 @@ import (
 
 	"device-analytics/entities"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -146,3 +147,448 @@ func TestUniqueDevices(t *testing.T) {
 	})
 
 }
+
+func TestLatestUniqueDevices(t *testing.T) {
+	t.Run("should return the most recent row", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/latest"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err, "Unable to read response")
+
+		n := entities.UniqueDevicesResponse{}
+		err = json.Unmarshal(body, &n)
+		require.NoError(t, err, "Unable to unmarshal response body")
+
+		require.Len(t, n.Items, 1, "Unexpected response length")
+
+		all := runQuery(t, "en.wikipedia", "all-sites", "daily", 20150101, 20300101)
+		assert.Equal(t, all.Items[len(all.Items)-1], n.Items[0], "Wrong contents")
+	})
+
+	t.Run("should return 404 for a project without data", func(t *testing.T) {
+
+		res, err := http.Get(testURL("wrong-project/all-sites/daily/latest"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusNotFound, res.StatusCode, "Wrong status code")
+	})
+}
+
+func TestRelativeDates(t *testing.T) {
+	t.Run("should echo the resolved range for relative dates", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/-30d/latest"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err, "Unable to read response")
+
+		n := entities.UniqueDevicesResponse{}
+		err = json.Unmarshal(body, &n)
+		require.NoError(t, err, "Unable to unmarshal response body")
+
+		require.NotNil(t, n.Range, "Missing resolved range")
+		assert.LessOrEqual(t, n.Range.Start, n.Range.End, "Start after end")
+	})
+
+	t.Run("should not include a range for absolute dates", func(t *testing.T) {
+
+		n := runQuery(t, "en.wikipedia", "all-sites", "daily", 20210101, 20210201)
+
+		assert.Nil(t, n.Range, "Unexpected range")
+	})
+
+	t.Run("should return 400 for unknown relative dates", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/tomorrow/latest"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusBadRequest, res.StatusCode, "Wrong status code")
+	})
+}
+
+func TestFormats(t *testing.T) {
+	t.Run("should return CSV when requested in the Accept header", func(t *testing.T) {
+
+		req, err := http.NewRequest(http.MethodGet, testURL("en.wikipedia.org/all-sites/daily/20210101/20210201"), nil)
+		require.NoError(t, err, "Invalid http request")
+		req.Header.Set("Accept", "text/csv")
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+		assert.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/csv"), "Wrong content type")
+		assert.Contains(t, res.Header.Get("Content-Disposition"), ".csv", "Wrong filename")
+		assert.Contains(t, res.Header.Values("Vary"), "Accept", "Missing Vary: Accept")
+
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err, "Unable to read response")
+
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		assert.Equal(t, "project,access-site,granularity,timestamp,devices,offset,underestimate", lines[0], "Wrong header")
+		assert.Len(t, lines, 32, "Unexpected response length")
+	})
+
+	t.Run("should return TSV when requested with the format parameter", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/20210101/20210201?format=tsv"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+		assert.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/tab-separated-values"), "Wrong content type")
+		assert.Contains(t, res.Header.Values("Vary"), "Accept", "Missing Vary: Accept")
+	})
+
+	t.Run("should stream newline-delimited JSON when requested", func(t *testing.T) {
+
+		req, err := http.NewRequest(http.MethodGet, testURL("en.wikipedia.org/all-sites/daily/20210101/20210201"), nil)
+		require.NoError(t, err, "Invalid http request")
+		req.Header.Set("Accept", "application/x-ndjson")
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+		assert.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"), "Wrong content type")
+
+		decoder := json.NewDecoder(res.Body)
+		var items []entities.UniqueDevices
+		for decoder.More() {
+			var item entities.UniqueDevices
+			require.NoError(t, decoder.Decode(&item), "Unable to decode line")
+			items = append(items, item)
+		}
+
+		assert.Equal(t, runQuery(t, "en.wikipedia", "all-sites", "daily", 20210101, 20210201).Items, items, "Wrong contents")
+	})
+
+	t.Run("should return 404 before streaming when there is no data", func(t *testing.T) {
+
+		res, err := http.Get(testURL("wrong-project/all-sites/daily/20210101/20210201?format=ndjson"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusNotFound, res.StatusCode, "Wrong status code")
+	})
+
+	t.Run("should return 400 for an unsupported format", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/20210101/20210201?format=xml"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusBadRequest, res.StatusCode, "Wrong status code")
+	})
+}
+
+func TestCompression(t *testing.T) {
+	t.Run("should compress large responses when the client accepts it", func(t *testing.T) {
+
+		req, err := http.NewRequest(http.MethodGet, testURL("en.wikipedia.org/all-sites/daily/20210101/20210201"), nil)
+		require.NoError(t, err, "Invalid http request")
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "Wrong content encoding")
+	})
+
+	t.Run("should return compact JSON unless pretty printing is requested", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/20210101/20210201"))
+		require.NoError(t, err, "Invalid http request")
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err, "Unable to read response")
+		assert.NotContains(t, string(body), "\n", "Unexpected indentation")
+
+		res, err = http.Get(testURL("en.wikipedia.org/all-sites/daily/20210101/20210201?pretty=1"))
+		require.NoError(t, err, "Invalid http request")
+		body, err = ioutil.ReadAll(res.Body)
+		require.NoError(t, err, "Unable to read response")
+		assert.Contains(t, string(body), "\n", "Missing indentation")
+	})
+}
+
+func TestConditionalRequests(t *testing.T) {
+	url := testURL("en.wikipedia.org/all-sites/daily/20210101/20210201")
+
+	res, err := http.Get(url)
+	require.NoError(t, err, "Invalid http request")
+	require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+
+	t.Run("should include validators", func(t *testing.T) {
+		assert.NotEmpty(t, etag, "Missing ETag")
+		assert.Equal(t, "Mon, 01 Feb 2021 00:00:00 GMT", lastModified, "Wrong Last-Modified")
+	})
+
+	t.Run("should return 304 when If-None-Match matches", func(t *testing.T) {
+
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err, "Invalid http request")
+		req.Header.Set("If-None-Match", etag)
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusNotModified, res.StatusCode, "Wrong status code")
+		// The ETag is weakened when the body is compressed
+		assert.Equal(t, strings.TrimPrefix(etag, "W/"), strings.TrimPrefix(res.Header.Get("ETag"), "W/"), "Wrong ETag")
+	})
+
+	t.Run("should return 200 when If-None-Match does not match", func(t *testing.T) {
+
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err, "Invalid http request")
+		req.Header.Set("If-None-Match", `"stale"`)
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+	})
+
+	t.Run("should return 304 when not modified since", func(t *testing.T) {
+
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err, "Invalid http request")
+		req.Header.Set("If-Modified-Since", lastModified)
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusNotModified, res.StatusCode, "Wrong status code")
+	})
+}
+
+func TestCacheControl(t *testing.T) {
+	t.Run("should mark loaded ranges in the past as immutable", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/20210101/20210201"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+		assert.Contains(t, res.Header.Get("Cache-Control"), "immutable", "Wrong Cache-Control")
+	})
+
+	t.Run("should only briefly cache ranges touching the current period", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/-30d/today"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		assert.NotContains(t, res.Header.Get("Cache-Control"), "immutable", "Wrong Cache-Control")
+	})
+
+	t.Run("should only briefly cache relative ranges, even when complete", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/-30d/yesterday"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		assert.NotContains(t, res.Header.Get("Cache-Control"), "immutable", "Wrong Cache-Control")
+		assert.NotContains(t, res.Header.Get("Cache-Control"), "max-age=31536000", "Wrong Cache-Control")
+	})
+
+	t.Run("should only briefly cache 404 responses", func(t *testing.T) {
+
+		res, err := http.Get(testURL("wrong-project/all-sites/daily/20210101/20210201"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusNotFound, res.StatusCode, "Wrong status code")
+		assert.Equal(t, "public, max-age=300", res.Header.Get("Cache-Control"), "Wrong Cache-Control")
+	})
+}
+
+func TestPagination(t *testing.T) {
+	t.Run("should return every row across pages linked by next", func(t *testing.T) {
+
+		base, err := url.Parse(testURL(""))
+		require.NoError(t, err, "Invalid test URL")
+
+		var items []entities.UniqueDevices
+		next := testURL("en.wikipedia.org/all-sites/daily/20210101/20210201?limit=10")
+		for pages := 0; next != ""; pages++ {
+			require.Less(t, pages, 10, "Too many pages")
+
+			res, err := http.Get(next)
+			require.NoError(t, err, "Invalid http request")
+			require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err, "Unable to read response")
+
+			n := entities.UniqueDevicesResponse{}
+			require.NoError(t, json.Unmarshal(body, &n), "Unable to unmarshal response body")
+			assert.LessOrEqual(t, len(n.Items), 10, "Page too long")
+			items = append(items, n.Items...)
+
+			next = ""
+			if n.Next != "" {
+				assert.Equal(t, "<"+n.Next+`>; rel="next"`, res.Header.Get("Link"), "Wrong Link header")
+				ref, err := url.Parse(n.Next)
+				require.NoError(t, err, "Invalid next link")
+				next = base.ResolveReference(ref).String()
+			}
+		}
+
+		assert.Equal(t, runQuery(t, "en.wikipedia", "all-sites", "daily", 20210101, 20210201).Items, items, "Wrong contents")
+	})
+
+	t.Run("should return 400 for an invalid limit or cursor", func(t *testing.T) {
+
+		for _, query := range []string{"limit=0", "limit=bogus", "cursor=!!!"} {
+			res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/20210101/20210201?" + query))
+
+			require.NoError(t, err, "Invalid http request")
+
+			require.Equal(t, http.StatusBadRequest, res.StatusCode, "Wrong status code for "+query)
+		}
+	})
+
+	t.Run("should return 400 for a tampered cursor, or one from another query", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/20210101/20210201?limit=10"))
+		require.NoError(t, err, "Invalid http request")
+		require.Equal(t, http.StatusOK, res.StatusCode, "Wrong status code")
+
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err, "Unable to read response")
+		n := entities.UniqueDevicesResponse{}
+		require.NoError(t, json.Unmarshal(body, &n), "Unable to unmarshal response body")
+		ref, err := url.Parse(n.Next)
+		require.NoError(t, err, "Invalid next link")
+		cursor := ref.Query().Get("cursor")
+		require.NotEmpty(t, cursor, "Missing cursor")
+
+		tampered := []byte(cursor)
+		if tampered[0] == 'A' {
+			tampered[0] = 'B'
+		} else {
+			tampered[0] = 'A'
+		}
+		for _, suffix := range []string{
+			"en.wikipedia.org/all-sites/daily/20210101/20210201?limit=10&cursor=" + string(tampered),
+			"en.wikipedia.org/all-sites/daily/20210102/20210201?limit=10&cursor=" + cursor,
+			"en.wikipedia.org/mobile-site/daily/20210101/20210201?limit=10&cursor=" + cursor,
+		} {
+			res, err := http.Get(testURL(suffix))
+
+			require.NoError(t, err, "Invalid http request")
+
+			require.Equal(t, http.StatusBadRequest, res.StatusCode, "Wrong status code for "+suffix)
+		}
+	})
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, suffix := range []string{"en.wikipedia.org/all-sites/daily/20210101/20210201", "invalid/route"} {
+		t.Run("should set security headers on "+suffix, func(t *testing.T) {
+
+			res, err := http.Get(testURL(suffix))
+
+			require.NoError(t, err, "Invalid http request")
+
+			assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"), "Wrong X-Content-Type-Options")
+			assert.NotEmpty(t, res.Header.Get("Content-Security-Policy"), "Missing Content-Security-Policy")
+			assert.NotEmpty(t, res.Header.Get("Referrer-Policy"), "Missing Referrer-Policy")
+			assert.Empty(t, res.Header.Get("X-XSS-Protection"), "Unexpected X-XSS-Protection")
+		})
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	t.Run("should serve 404 problems as application/problem+json", func(t *testing.T) {
+
+		res, err := http.Get(testURL("invalid/route"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusNotFound, res.StatusCode, "Wrong status code")
+		assert.Equal(t, "application/problem+json", res.Header.Get("Content-Type"), "Wrong content type")
+	})
+
+	t.Run("should return 405 with an Allow header for an unsupported method", func(t *testing.T) {
+
+		res, err := http.Post(testURL("en.wikipedia.org/all-sites/daily/20210101/20210201"), "application/json", nil)
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode, "Wrong status code")
+		assert.Contains(t, res.Header.Get("Allow"), http.MethodGet, "Wrong Allow header")
+		assert.Equal(t, "application/problem+json", res.Header.Get("Content-Type"), "Wrong content type")
+		assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"), "Missing security headers")
+	})
+}
+
+func TestRangeLimits(t *testing.T) {
+	t.Run("should reject ranges longer than the configured limit", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/hourly/2019010100/2021010100"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		require.Equal(t, http.StatusBadRequest, res.StatusCode, "Wrong status code")
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err, "Unable to read response")
+		assert.Contains(t, string(body), "more than the limit", "Wrong problem detail")
+	})
+
+	t.Run("should not limit ranges within the configured limit", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/hourly/2021010100/2021010200"))
+
+		require.NoError(t, err, "Invalid http request")
+
+		assert.NotEqual(t, http.StatusBadRequest, res.StatusCode, "Wrong status code")
+	})
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	t.Run("should use a client budget smaller than the configured timeout", func(t *testing.T) {
+
+		req, err := http.NewRequest(http.MethodGet, testURL("en.wikipedia.org/all-sites/daily/20210101/20210201"), nil)
+		require.NoError(t, err, "Invalid http request")
+		req.Header.Set("X-Request-Timeout", "1")
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "Invalid http request")
+
+		assert.Equal(t, "1", res.Header.Get("X-Effective-Timeout"), "Wrong effective timeout")
+	})
+
+	t.Run("should never extend the configured timeout", func(t *testing.T) {
+
+		res, err := http.Get(testURL("en.wikipedia.org/all-sites/daily/20210101/20210201"))
+		require.NoError(t, err, "Invalid http request")
+		configured, err := strconv.Atoi(res.Header.Get("X-Effective-Timeout"))
+		require.NoError(t, err, "Missing effective timeout")
+
+		req, err := http.NewRequest(http.MethodGet, testURL("en.wikipedia.org/all-sites/daily/20210101/20210201"), nil)
+		require.NoError(t, err, "Invalid http request")
+		req.Header.Set("X-Request-Timeout", strconv.Itoa(configured*10))
+
+		res, err = http.DefaultClient.Do(req)
+		require.NoError(t, err, "Invalid http request")
+
+		assert.Equal(t, strconv.Itoa(configured), res.Header.Get("X-Effective-Timeout"), "Wrong effective timeout")
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"device-analytics/configuration"
+	"device-analytics/logic"
+
+	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
+	"github.com/gocql/gocql"
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+)
+
+// LatestHandler is the HTTP handler for latest unique-devices requests.
+type LatestHandler struct {
+	logger  *logger.Logger
+	session *gocql.Session
+	logic   *logic.UniqueDevicesLogic
+	config  *configuration.Config
+}
+
+// API documentation
+// @summary      Get the most recent unique devices for a project
+// @router       /unique-devices/{project}/{access-site}/{granularity}/latest  [get]
+// @description  Given a Wikimedia project, access method and granularity, returns the number of unique devices for the most recent period available.
+// @param        project      path  string  true  "Domain of a Wikimedia project"  example(en.wikipedia.org)
+// @param        access-site  path  string  true  "Method of access"               example(all-sites)  Enums(all-sites, desktop-site, mobile-site)
+// @param        granularity  path  string  true  "Time unit for response data"    example(daily)  Enums(daily, monthly)
+// @param        time_format  query string  false "Set to iso8601 to include RFC 3339 period bounds, the period duration and range"  Enums(iso8601)
+// @param        format       query string  false "Response format, overriding the Accept header"  Enums(json, csv, tsv, ndjson)
+// @produce      json
+// @produce      text/csv
+// @produce      text/tab-separated-values
+// @produce      application/x-ndjson
+// @success      200  {object}  entities.UniqueDevicesResponse
+// @success      304
+func (s *LatestHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	var err error
+
+	project := aqsassist.TrimProjectDomain(ctx.UserValue("project").(string))
+	accessSite := strings.ToLower(ctx.UserValue("access-site").(string))
+	granularity := strings.ToLower(ctx.UserValue("granularity").(string))
+
+	if granularity != "daily" && granularity != "monthly" && granularity != "hourly" {
+		problemResp := aqsassist.CreateProblem(http.StatusBadRequest, "Invalid granularity", string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	format, ok := negotiateFormat(ctx)
+	if !ok {
+		problemResp := aqsassist.CreateProblem(http.StatusBadRequest, invalidFormatDetail, string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	c, cancel := requestContext(ctx, ctx, s.config, time.Duration(s.config.ContextTimeout)*time.Millisecond)
+	defer cancel()
+	pbm, response := s.logic.ProcessLatestUniqueDevicesLogic(c, ctx, project, accessSite, granularity, s.session, s.logger)
+	if pbm != nil {
+		if ctx.Response.StatusCode() == http.StatusNotFound {
+			setNotFoundCacheControl(ctx, s.config)
+		}
+		problemResp, _ := json.Marshal(pbm)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	if isoTimeFormat(ctx) {
+		timestamp := response.Items[0].Timestamp
+		if err = logic.AddTimeMetadata(&response, granularity, timestamp, timestamp); err != nil {
+			s.logger.Log(logger.ERROR, "Unable to add time metadata: %s", err)
+			problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			ctx.SetBody(problemResp)
+			return
+		}
+		// The range is the period of the returned row
+		response.Range.StartTime = response.Items[0].PeriodStart
+		response.Range.EndTime = response.Items[0].PeriodEnd
+	}
+
+	setLastModified(ctx, response.Items)
+	// The latest row changes whenever new data is loaded
+	setCurrentCacheControl(ctx, s.config, granularity)
+
+	if format == formatCSV || format == formatTSV {
+		if err = writeDelimited(ctx, format, response, "unique-devices", project, accessSite, granularity, "latest"); err != nil {
+			s.logger.Log(logger.ERROR, "Unable to write %s response: %s", format, err)
+			problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+			ctx.ResetBody()
+			ctx.SetContentType("application/json; charset=utf-8")
+			ctx.Response.Header.Del("Content-Disposition")
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			ctx.SetBody(problemResp)
+		}
+		return
+	}
+
+	if format == formatNDJSON {
+		ctx.SetContentType(formatContentTypes[formatNDJSON])
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		_ = json.NewEncoder(ctx).Encode(response.Items[0])
+		return
+	}
+
+	var data []byte
+	if data, err = marshalJSON(ctx, response); err != nil {
+		s.logger.Log(logger.ERROR, "Unable to marshal response object: %s", err)
+		problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(data)
+}
@@ -0,0 +1,72 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// First file descriptor passed by systemd socket activation (see sd_listen_fds(3))
+const systemdFirstFD = 3
+
+// Listen returns a listener for address, which is one of:
+//   - host:port, for TCP
+//   - unix:/path/to/socket, for a Unix domain socket, created with the given permissions
+//     (a stale socket left at the path is replaced, and the socket is removed when the
+//     listener is closed)
+//   - systemd or systemd:N, for the first (or Nth, counting from 0) socket passed by
+//     systemd socket activation (LISTEN_FDS)
+func Listen(address string, mode os.FileMode) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		return listenUnix(strings.TrimPrefix(address, "unix:"), mode)
+	case address == "systemd":
+		return listenSystemd(0)
+	case strings.HasPrefix(address, "systemd:"):
+		index, err := strconv.Atoi(strings.TrimPrefix(address, "systemd:"))
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("Invalid systemd socket: %s", address)
+		}
+		return listenSystemd(index)
+	}
+	return net.Listen("tcp", address)
+}
+
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// A previous process may not have been able to remove its socket, but never remove
+	// anything else
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func listenSystemd(index int) (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("No sockets were passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || index >= count {
+		return nil, fmt.Errorf("systemd passed %s socket(s), socket %d requested", os.Getenv("LISTEN_FDS"), index)
+	}
+
+	file := os.NewFile(uintptr(systemdFirstFD+index), "systemd:"+strconv.Itoa(index))
+	defer file.Close()
+	return net.FileListener(file)
+}
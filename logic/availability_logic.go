@@ -0,0 +1,104 @@
+package logic
+
+import (
+	"context"
+	"device-analytics/cache"
+	"device-analytics/entities"
+	"net/http"
+	"time"
+
+	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
+	"github.com/gocql/gocql"
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+	"schneider.vip/problem"
+)
+
+// AvailabilityLogic computes the range of data available for a project, access method
+// and granularity. Results (including the absence of data) are cached in-process, since
+// finding them requires reading every timestamp in the partition.
+type AvailabilityLogic struct {
+	cache *cache.Cache
+}
+
+// NewAvailabilityLogic returns an AvailabilityLogic that caches results in c.
+func NewAvailabilityLogic(c *cache.Cache) *AvailabilityLogic {
+	return &AvailabilityLogic{cache: c}
+}
+
+func (s *AvailabilityLogic) ProcessAvailabilityLogic(context context.Context, ctx *fasthttp.RequestCtx, project, accessSite, granularity string, session *gocql.Session, rLogger *logger.Logger) (*problem.Problem, entities.AvailabilityResponse) {
+	availability, err := s.Availability(context, project, accessSite, granularity, session)
+	if err != nil {
+		return QueryProblem(ctx, err, rLogger), entities.AvailabilityResponse{}
+	}
+
+	if availability == nil {
+		str := "We do not have data for the project, access method and granularity you asked for.  Please check documentation for more information."
+		problemResp := aqsassist.CreateProblem(http.StatusNotFound, str, string(ctx.Request.URI().RequestURI()))
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetBody(problemResp.JSON())
+		return problemResp, entities.AvailabilityResponse{}
+	}
+
+	return nil, entities.AvailabilityResponse{Items: []entities.Availability{*availability}}
+}
+
+// Availability returns the earliest and latest timestamps, and any gaps between them, for
+// the given project, access method and granularity. A nil result (and nil error) means no
+// data is available.
+func (s *AvailabilityLogic) Availability(c context.Context, project, accessSite, granularity string, session *gocql.Session) (*entities.Availability, error) {
+	key := project + "/" + accessSite + "/" + granularity
+	value, err := s.cache.Get(c, key, func(load context.Context) (interface{}, error) {
+		return queryAvailability(load, project, accessSite, granularity, session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*entities.Availability), nil
+}
+
+func queryAvailability(context context.Context, project, accessSite, granularity string, session *gocql.Session) (*entities.Availability, error) {
+	query := `SELECT timestamp FROM "local_group_default_T_unique_devices".data WHERE "_domain" = 'analytics.wikimedia.org' AND project = ? AND "access-site" = ? AND granularity = ?`
+	q, err := newQuery(context, session, query, project, accessSite, granularity)
+	if err != nil {
+		return nil, err
+	}
+	scanner := q.Iter().Scanner()
+
+	var availability *entities.Availability
+	var previous time.Time
+	var timestamp string
+
+	for scanner.Next() {
+		if err := scanner.Scan(&timestamp); err != nil {
+			_ = scanner.Err() // closes the iterator
+			return nil, err
+		}
+		current, err := ParseTimestamp(timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		if availability == nil {
+			availability = &entities.Availability{
+				Project:     project,
+				AccessSite:  accessSite,
+				Granularity: granularity,
+				Earliest:    timestamp,
+				Gaps:        make([]entities.Gap, 0),
+			}
+		} else if expected := nextPeriod(previous, granularity); current.After(expected) {
+			availability.Gaps = append(availability.Gaps, entities.Gap{
+				Start: formatTimestamp(expected, timestamp),
+				End:   formatTimestamp(previousPeriod(current, granularity), timestamp),
+			})
+		}
+		availability.Latest = timestamp
+		previous = current
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return availability, nil
+}
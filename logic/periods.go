@@ -0,0 +1,168 @@
+package logic
+
+import (
+	"device-analytics/entities"
+	"fmt"
+	"time"
+)
+
+// Timestamps are stored as YYYYMMDD, or YYYYMMDDHH for hourly data.
+const (
+	dailyTimestampLayout  = "20060102"
+	hourlyTimestampLayout = "2006010215"
+)
+
+// ParseTimestamp parses a timestamp in YYYYMMDD or YYYYMMDDHH format.
+func ParseTimestamp(timestamp string) (time.Time, error) {
+	switch len(timestamp) {
+	case len(dailyTimestampLayout):
+		return time.Parse(dailyTimestampLayout, timestamp)
+	case len(hourlyTimestampLayout):
+		return time.Parse(hourlyTimestampLayout, timestamp)
+	}
+	return time.Time{}, fmt.Errorf("Unrecognized timestamp format: %s", timestamp)
+}
+
+// formatTimestamp formats t using the same layout as the stored timestamp like.
+func formatTimestamp(t time.Time, like string) string {
+	if len(like) == len(hourlyTimestampLayout) {
+		return t.Format(hourlyTimestampLayout)
+	}
+	return t.Format(dailyTimestampLayout)
+}
+
+func nextPeriod(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case "hourly":
+		return t.Add(time.Hour)
+	case "monthly":
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+func previousPeriod(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case "hourly":
+		return t.Add(-time.Hour)
+	case "monthly":
+		return t.AddDate(0, -1, 0)
+	}
+	return t.AddDate(0, 0, -1)
+}
+
+// PeriodDuration returns the ISO 8601 duration of one period of granularity.
+func PeriodDuration(granularity string) string {
+	switch granularity {
+	case "hourly":
+		return "PT1H"
+	case "monthly":
+		return "P1M"
+	}
+	return "P1D"
+}
+
+// PeriodBounds returns the start and (exclusive) end of the period of granularity that
+// begins at timestamp.
+func PeriodBounds(timestamp, granularity string) (time.Time, time.Time, error) {
+	start, err := ParseTimestamp(timestamp)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, nextPeriod(start, granularity), nil
+}
+
+// PeriodContaining returns the start and (exclusive) end of the period of granularity
+// that contains timestamp (e.g. the month, for monthly data).
+func PeriodContaining(timestamp, granularity string) (time.Time, time.Time, error) {
+	t, err := ParseTimestamp(timestamp)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	switch granularity {
+	case "hourly":
+		t = t.Truncate(time.Hour)
+	case "monthly":
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t, nextPeriod(t, granularity), nil
+}
+
+// PeriodCount returns the number of periods of granularity touched by the range from
+// start to end, inclusive.
+func PeriodCount(start, end, granularity string) (int, error) {
+	first, _, err := PeriodContaining(start, granularity)
+	if err != nil {
+		return 0, err
+	}
+	last, _, err := PeriodContaining(end, granularity)
+	if err != nil {
+		return 0, err
+	}
+	switch granularity {
+	case "hourly":
+		return int(last.Sub(first)/time.Hour) + 1, nil
+	case "monthly":
+		return (last.Year()-first.Year())*12 + int(last.Month()) - int(first.Month()) + 1, nil
+	}
+	return int(last.Sub(first)/(24*time.Hour)) + 1, nil
+}
+
+// TruncateRange returns the end of a range beginning at start that touches n periods of
+// granularity, and the start of the range that follows it, in YYYYMMDDHH format.
+func TruncateRange(start string, n int, granularity string) (string, string, error) {
+	first, _, err := PeriodContaining(start, granularity)
+	if err != nil {
+		return "", "", err
+	}
+	next := first
+	for i := 0; i < n; i++ {
+		next = nextPeriod(next, granularity)
+	}
+	// The end is the last hour (or day) before the next range
+	end := next.AddDate(0, 0, -1)
+	if granularity == "hourly" {
+		end = next.Add(-time.Hour)
+	}
+	return end.Format(hourlyTimestampLayout), next.Format(hourlyTimestampLayout), nil
+}
+
+// AddTimeMetadata adds the RFC 3339 start and end of each row's period, the period
+// duration, and the bounds of the requested range (start through end, inclusive) to
+// response.
+func AddTimeMetadata(response *entities.UniqueDevicesResponse, granularity, start, end string) error {
+	for i := range response.Items {
+		periodStart, periodEnd, err := PeriodBounds(response.Items[i].Timestamp, granularity)
+		if err != nil {
+			return err
+		}
+		response.Items[i].PeriodStart = periodStart.Format(time.RFC3339)
+		response.Items[i].PeriodEnd = periodEnd.Format(time.RFC3339)
+	}
+
+	// The range is of dates (or hours), whatever the granularity
+	rangeStart, err := ParseTimestamp(start)
+	if err != nil {
+		return err
+	}
+	rangeEnd, err := ParseTimestamp(end)
+	if err != nil {
+		return err
+	}
+	if granularity == "hourly" {
+		rangeEnd = rangeEnd.Add(time.Hour)
+	} else {
+		rangeEnd = rangeEnd.AddDate(0, 0, 1)
+	}
+
+	response.Period = PeriodDuration(granularity)
+	response.Range = &entities.Range{
+		Start:     start,
+		End:       end,
+		StartTime: rangeStart.Format(time.RFC3339),
+		EndTime:   rangeEnd.Format(time.RFC3339),
+	}
+	return nil
+}
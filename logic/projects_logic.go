@@ -0,0 +1,191 @@
+package logic
+
+import (
+	"context"
+	"crypto/sha256"
+	"device-analytics/entities"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
+	"github.com/gocql/gocql"
+)
+
+// ProjectsLogic maintains the catalogue of projects for which unique devices data is
+// available. The catalogue is rebuilt from Cassandra in the background (see Run), and
+// requests are served from the most recent snapshot.
+type ProjectsLogic struct {
+	mu        sync.RWMutex
+	catalogue *entities.ProjectsResponse
+	etag      string
+	updated   time.Time
+}
+
+// Families whose subdomains are language codes.
+var multilingualFamilies = map[string]bool{
+	"wikibooks":   true,
+	"wikinews":    true,
+	"wikipedia":   true,
+	"wikiquote":   true,
+	"wikisource":  true,
+	"wikiversity": true,
+	"wikivoyage":  true,
+	"wiktionary":  true,
+}
+
+// Catalogue returns the most recent catalogue snapshot, its entity tag, and the time it
+// was built. The catalogue is nil until the first refresh has completed.
+func (s *ProjectsLogic) Catalogue() (*entities.ProjectsResponse, string, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.catalogue, s.etag, s.updated
+}
+
+// Run refreshes the catalogue immediately, and then every interval until context is done.
+func (s *ProjectsLogic) Run(context context.Context, session *gocql.Session, interval time.Duration, rLogger *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Refresh(context, session, interval); err != nil {
+			rLogger.Log(logger.ERROR, "Unable to refresh project catalogue: %s", err)
+		}
+		select {
+		case <-context.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh rebuilds the catalogue from Cassandra, giving up after timeout.
+func (s *ProjectsLogic) Refresh(parent context.Context, session *gocql.Session, timeout time.Duration) error {
+	c, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	query := `SELECT DISTINCT "_domain", project, "access-site", granularity FROM "local_group_default_T_unique_devices".data`
+	q, err := newQuery(c, session, query)
+	if err != nil {
+		return err
+	}
+	scanner := q.Iter().Scanner()
+
+	projects := make(map[string]*entities.Project)
+	var domain, project, accessSite, granularity string
+
+	for scanner.Next() {
+		if err := scanner.Scan(&domain, &project, &accessSite, &granularity); err != nil {
+			return err
+		}
+		if domain != "analytics.wikimedia.org" {
+			continue
+		}
+
+		earliest, latest, err := partitionBounds(c, project, accessSite, granularity, session)
+		if err != nil {
+			return err
+		}
+		if earliest == "" {
+			continue
+		}
+
+		entry, ok := projects[project]
+		if !ok {
+			entry = newProject(project)
+			projects[project] = entry
+		}
+		coverage, ok := entry.Coverage[granularity]
+		if !ok || earliest < coverage.Earliest {
+			coverage.Earliest = earliest
+		}
+		if latest > coverage.Latest {
+			coverage.Latest = latest
+		}
+		entry.Coverage[granularity] = coverage
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	catalogue := &entities.ProjectsResponse{Items: make([]entities.Project, 0, len(projects))}
+	for _, entry := range projects {
+		catalogue.Items = append(catalogue.Items, *entry)
+	}
+	sort.Slice(catalogue.Items, func(i, j int) bool {
+		return catalogue.Items[i].Project < catalogue.Items[j].Project
+	})
+
+	data, err := json.Marshal(catalogue)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+
+	s.mu.Lock()
+	s.catalogue = catalogue
+	s.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	s.updated = time.Now()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// newProject returns a catalogue entry for a project in the form stored in Cassandra
+// (e.g. en.wikipedia), with the domain, family and language derived from it.
+func newProject(project string) *entities.Project {
+	entry := &entities.Project{
+		Project:  project,
+		Domain:   ProjectDomain(project),
+		Family:   project,
+		Coverage: make(map[string]entities.Coverage),
+	}
+	if parts := strings.SplitN(project, ".", 2); len(parts) == 2 {
+		entry.Family = parts[1]
+		if multilingualFamilies[parts[1]] {
+			entry.Language = parts[0]
+		}
+	}
+	return entry
+}
+
+// ProjectDomain returns the domain of a project in the form stored in Cassandra, reversing
+// aqsassist.TrimProjectDomain: en.wikipedia and commons.wikimedia are served from
+// en.wikipedia.org and commons.wikimedia.org, and single-label projects such as wikidata
+// from www.wikidata.org.
+func ProjectDomain(project string) string {
+	project = strings.ToLower(project)
+	if !strings.Contains(project, ".") {
+		return "www." + project + ".org"
+	}
+	return project + ".org"
+}
+
+// partitionBounds returns the first and last timestamps stored for a project, access
+// method and granularity, reading a single row from each end of the partition.
+func partitionBounds(context context.Context, project, accessSite, granularity string, session *gocql.Session) (string, string, error) {
+	var earliest, latest string
+	query := `SELECT timestamp FROM "local_group_default_T_unique_devices".data WHERE "_domain" = 'analytics.wikimedia.org' AND project = ? AND "access-site" = ? AND granularity = ?`
+
+	first, err := newQuery(context, session, query+` ORDER BY timestamp ASC LIMIT 1`, project, accessSite, granularity)
+	if err != nil {
+		return "", "", err
+	}
+	if err := first.Scan(&earliest); err != nil {
+		if err == gocql.ErrNotFound {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	last, err := newQuery(context, session, query+` ORDER BY timestamp DESC LIMIT 1`, project, accessSite, granularity)
+	if err != nil {
+		return "", "", err
+	}
+	if err := last.Scan(&latest); err != nil {
+		return "", "", err
+	}
+	return earliest, latest, nil
+}
@@ -0,0 +1,231 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"device-analytics/breaker"
+
+	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+	"schneider.vip/problem"
+)
+
+var (
+	queryAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "device_analytics_cassandra_attempts_total",
+		Help: "Number of attempts at executing Cassandra queries, including retries and speculative executions, by result (success or error).",
+	}, []string{"result"})
+	queryRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "device_analytics_cassandra_retries_total",
+		Help: "Number of Cassandra query retries.",
+	})
+	querySpeculativeExecutions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "device_analytics_cassandra_speculative_executions_total",
+		Help: "Number of speculative executions of Cassandra queries.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queryAttempts, queryRetries, querySpeculativeExecutions)
+}
+
+// QueryPolicies configures how the queries of this package are executed.
+type QueryPolicies struct {
+	// Speculative execution, for none if nil
+	Speculative *gocql.SimpleSpeculativeExecution
+	// Retries, for a single attempt if nil
+	Retry *BackoffRetryPolicy
+	// Circuit breaker, through which every attempt is recorded, for none if nil
+	Breaker *breaker.Breaker
+}
+
+var policies QueryPolicies
+
+// SetQueryPolicies sets the policies of every query made by this package. It must be
+// called before any query is made.
+func SetQueryPolicies(p QueryPolicies) {
+	policies = p
+}
+
+type clientDeadlineKey struct{}
+
+// WithClientDeadline marks c as bounded by a deadline the client asked for, rather than by
+// the server's own timeout.
+func WithClientDeadline(c context.Context) context.Context {
+	return context.WithValue(c, clientDeadlineKey{}, true)
+}
+
+// BreakerCounts reports whether the circuit breaker records the outcome of a query attempt
+// made under context c, that ended with err (nil on success). Cancelled attempts (such as
+// speculative executions overtaken by another attempt) are not recorded, and neither are
+// attempts that ran out of a deadline set by the client, lest clients open the breaker at
+// will by asking for impossibly short deadlines.
+func BreakerCounts(c context.Context, err error) bool {
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	clientDeadline, _ := c.Value(clientDeadlineKey{}).(bool)
+	return !clientDeadline || (!errors.Is(err, context.DeadlineExceeded) && c.Err() != context.DeadlineExceeded)
+}
+
+// IsCircuitOpen reports whether err is the rejection of a query by the circuit breaker.
+func IsCircuitOpen(err error) bool {
+	var open *breaker.OpenError
+	return errors.As(err, &open)
+}
+
+// QueryFailedDetail is the problem detail for failed queries; driver errors are logged,
+// but not shown to clients.
+const QueryFailedDetail = "The data store was unable to answer the query; please try again later"
+
+// QueryProblem sets the problem for a failed query on the response, and returns it: a 503
+// with Retry-After if the circuit breaker rejected the query, and a 500 otherwise.
+func QueryProblem(ctx *fasthttp.RequestCtx, err error, rLogger *logger.Logger) *problem.Problem {
+	status, detail := http.StatusInternalServerError, QueryFailedDetail
+	var open *breaker.OpenError
+	if errors.As(err, &open) {
+		rLogger.Log(logger.DEBUG, "Query rejected: %s", err)
+		status, detail = http.StatusServiceUnavailable, err.Error()
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(open.RetryAfter.Seconds()))))
+	} else {
+		rLogger.Log(logger.ERROR, "Query failed: %s", err)
+	}
+
+	problemResp := aqsassist.CreateProblem(status, detail, string(ctx.Request.URI().RequestURI()))
+	ctx.SetStatusCode(status)
+	ctx.SetBody(problemResp.JSON())
+	return problemResp
+}
+
+// newQuery returns a query of stmt, bound to context. Every query made by this package is
+// a read, and so idempotent: safe to retry or execute speculatively. If the circuit
+// breaker is open, it returns a *breaker.OpenError instead.
+func newQuery(context context.Context, session *gocql.Session, stmt string, values ...interface{}) (*gocql.Query, error) {
+	if policies.Breaker != nil {
+		if err := policies.Breaker.Allow(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	tracker := &attemptTracker{}
+	query := session.Query(stmt, values...).WithContext(context).Idempotent(true).Observer(tracker)
+	if policies.Speculative != nil {
+		query = query.SetSpeculativeExecutionPolicy(policies.Speculative)
+	}
+	if policies.Retry != nil {
+		query = query.RetryPolicy(&trackedRetryPolicy{policy: policies.Retry, tracker: tracker})
+	}
+	return query, nil
+}
+
+// attemptTracker counts the attempts at executing a query. An attempt after the first is
+// either a retry, or a speculative execution; retries are announced by the retry policy
+// before they are attempted, so attempts that were not announced are speculative. The
+// outcome of attempts is recorded by the circuit breaker (see BreakerCounts).
+type attemptTracker struct {
+	pendingRetries int32
+}
+
+func (t *attemptTracker) ObserveQuery(c context.Context, q gocql.ObservedQuery) {
+	if q.Err != nil {
+		queryAttempts.WithLabelValues("error").Inc()
+	} else {
+		queryAttempts.WithLabelValues("success").Inc()
+	}
+	if q.Attempt > 0 && !t.consumeRetry() {
+		querySpeculativeExecutions.Inc()
+	}
+	if policies.Breaker != nil && BreakerCounts(c, q.Err) {
+		policies.Breaker.Record(q.End, q.Err != nil)
+	}
+}
+
+func (t *attemptTracker) consumeRetry() bool {
+	for {
+		pending := atomic.LoadInt32(&t.pendingRetries)
+		if pending == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&t.pendingRetries, pending, pending-1) {
+			return true
+		}
+	}
+}
+
+// trackedRetryPolicy is a retry policy that reports its retries to an attemptTracker.
+type trackedRetryPolicy struct {
+	policy  gocql.RetryPolicy
+	tracker *attemptTracker
+}
+
+func (r *trackedRetryPolicy) Attempt(q gocql.RetryableQuery) bool {
+	return r.policy.Attempt(q)
+}
+
+func (r *trackedRetryPolicy) GetRetryType(err error) gocql.RetryType {
+	retryType := r.policy.GetRetryType(err)
+	if retryType == gocql.Retry || retryType == gocql.RetryNextHost {
+		atomic.AddInt32(&r.tracker.pendingRetries, 1)
+		queryRetries.Inc()
+	}
+	return retryType
+}
+
+// BackoffRetryPolicy retries failed queries on the next host, up to NumRetries times,
+// waiting an exponentially growing (jittered) delay from Min up to Max in between. Unlike
+// gocql.ExponentialBackoffRetryPolicy, it gives up rather than retry if the delay would
+// leave no time before the query's deadline.
+type BackoffRetryPolicy struct {
+	NumRetries int
+	Min, Max   time.Duration
+}
+
+func (p *BackoffRetryPolicy) Attempt(q gocql.RetryableQuery) bool {
+	if q.Attempts() > p.NumRetries {
+		return false
+	}
+
+	delay := p.backoff(q.Attempts())
+	if deadline, ok := q.Context().Deadline(); ok && time.Until(deadline) <= delay {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-q.Context().Done():
+		return false
+	}
+}
+
+func (p *BackoffRetryPolicy) GetRetryType(err error) gocql.RetryType {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return gocql.Rethrow
+	}
+	return gocql.RetryNextHost
+}
+
+// backoff returns the delay before the given attempt (counting from 1 for the first retry).
+func (p *BackoffRetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.Min) * math.Pow(2, float64(attempt-1))
+	delay += (rand.Float64() - 0.5) * float64(p.Min) // jitter
+	if delay > float64(p.Max) {
+		return p.Max
+	}
+	return time.Duration(delay)
+}
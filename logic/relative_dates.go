@@ -0,0 +1,73 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoLatest is returned by ResolveTimestamp when `latest` is requested, but there is no
+// data to resolve it against.
+var ErrNoLatest = errors.New("No data is available to resolve latest")
+
+// Matches offsets relative to today, e.g. -30d or -12m
+var relativeOffset = regexp.MustCompile(`^-(\d+)([dmy])$`)
+
+// ResolveTimestamp resolves a relative date expression to an absolute timestamp in
+// YYYYMMDD format. Supported expressions are `today`, `yesterday`, `latest`, and offsets
+// from today in days, months or years (e.g. -30d, -12m, -1y). Dates are computed in UTC
+// relative to now; latest is called to find the most recent available timestamp when
+// needed. The boolean result is false (and expr is returned unchanged) when expr is not a
+// relative expression.
+func ResolveTimestamp(expr string, now time.Time, latest func() (string, error)) (string, bool, error) {
+	today := now.UTC()
+
+	switch strings.ToLower(expr) {
+	case "today":
+		return today.Format(dailyTimestampLayout), true, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1).Format(dailyTimestampLayout), true, nil
+	case "latest":
+		timestamp, err := latest()
+		if err != nil {
+			return "", true, err
+		}
+		if timestamp == "" {
+			return "", true, ErrNoLatest
+		}
+		return timestamp, true, nil
+	}
+
+	match := relativeOffset.FindStringSubmatch(strings.ToLower(expr))
+	if match == nil {
+		return expr, false, nil
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return "", true, fmt.Errorf("Invalid relative date: %s", expr)
+	}
+	switch match[2] {
+	case "d":
+		today = today.AddDate(0, 0, -n)
+	case "m":
+		today = addMonths(today, -n)
+	case "y":
+		today = addMonths(today, -12*n)
+	}
+	return today.Format(dailyTimestampLayout), true, nil
+}
+
+// addMonths adds n months to t, clamping the day to the end of the resulting month
+// (so that one month before March 31st is February 28th, rather than March 3rd).
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, n, 0)
+	last := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
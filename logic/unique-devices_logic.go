@@ -2,8 +2,10 @@ package logic
 
 import (
 	"context"
+	"device-analytics/cache"
 	"device-analytics/entities"
 	"net/http"
+	"strings"
 
 	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
 	"github.com/gocql/gocql"
@@ -13,25 +15,88 @@ import (
 )
 
 type UniqueDevicesLogic struct {
+	cache      *cache.Cache
+	serveStale bool
 }
 
+// NewUniqueDevicesLogic returns a UniqueDevicesLogic that caches query results in c, if
+// it is non-nil. With serveStale, expired results are served from c while the circuit
+// breaker is open.
+func NewUniqueDevicesLogic(c *cache.Cache, serveStale bool) *UniqueDevicesLogic {
+	return &UniqueDevicesLogic{cache: c, serveStale: serveStale}
+}
+
+// staleWarning marks responses served from expired cache entries (see RFC 7234, 5.5.1).
+const staleWarning = `110 - "Response is Stale"`
+
+// NotFoundDetail is the problem detail for valid requests that match no data.
+const NotFoundDetail = "The date(s) you used are valid, but we either do not have data for those date(s), or the project you asked for is not loaded yet.  Please check documentation for more information."
+
+const uniqueDevicesQuery = `SELECT devices, offset, underestimate, timestamp FROM "local_group_default_T_unique_devices".data WHERE "_domain" = 'analytics.wikimedia.org' AND project = ? AND "access-site" = ? AND granularity = ? AND timestamp >= ? AND timestamp <= ?`
+
 func (s *UniqueDevicesLogic) ProcessUniqueDevicesLogic(context context.Context, ctx *fasthttp.RequestCtx, project, accessSite, granularity, start, end string, session *gocql.Session, rLogger *logger.Logger) (*problem.Problem, entities.UniqueDevicesResponse) {
-	var err error
-	var problemData *problem.Problem
-	var response = entities.UniqueDevicesResponse{Items: make([]entities.UniqueDevices, 0)}
-	query := `SELECT devices, offset, underestimate, timestamp FROM "local_group_default_T_unique_devices".data WHERE "_domain" = 'analytics.wikimedia.org' AND project = ? AND "access-site" = ? AND granularity = ? AND timestamp >= ? AND timestamp <= ?`
-	scanner := session.Query(query, project, accessSite, granularity, start, end).WithContext(context).Iter().Scanner()
+	items, stale, err := s.uniqueDevices(context, project, accessSite, granularity, start, end, session)
+	if err != nil {
+		return QueryProblem(ctx, err, rLogger), entities.UniqueDevicesResponse{}
+	}
+
+	if len(items) == 0 {
+		problemResp := aqsassist.CreateProblem(http.StatusNotFound, NotFoundDetail, string(ctx.Request.URI().RequestURI()))
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetBody(problemResp.JSON())
+		return problemResp, entities.UniqueDevicesResponse{}
+	}
+	if stale {
+		ctx.Response.Header.Set("Warning", staleWarning)
+	}
+	return nil, entities.UniqueDevicesResponse{Items: items}
+}
+
+// uniqueDevices returns the rows in a range, from the cache when there is one. The rows
+// returned are a copy, and safe for the caller to modify. The boolean result reports
+// whether they are stale: read from an expired cache entry, because the circuit breaker
+// is open.
+func (s *UniqueDevicesLogic) uniqueDevices(c context.Context, project, accessSite, granularity, start, end string, session *gocql.Session) ([]entities.UniqueDevices, bool, error) {
+	if s.cache == nil {
+		items, err := queryUniqueDevices(c, project, accessSite, granularity, start, end, session)
+		return items, false, err
+	}
+
+	key := strings.Join([]string{project, accessSite, granularity, start, end}, "/")
+	value, err := s.cache.Get(c, key, func(load context.Context) (interface{}, error) {
+		return queryUniqueDevices(load, project, accessSite, granularity, start, end, session)
+	})
+	stale := false
+	if err != nil {
+		if !s.serveStale || !IsCircuitOpen(err) {
+			return nil, false, err
+		}
+		if value, stale = s.cache.GetStale(key); !stale {
+			return nil, false, err
+		}
+	}
+	return append([]entities.UniqueDevices(nil), value.([]entities.UniqueDevices)...), stale, nil
+}
+
+func queryUniqueDevices(context context.Context, project, accessSite, granularity, start, end string, session *gocql.Session) ([]entities.UniqueDevices, error) {
+	query, err := newQuery(context, session, uniqueDevicesQuery, project, accessSite, granularity, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return scanUniqueDevices(query.Iter().Scanner(), project, accessSite, granularity)
+}
+
+func scanUniqueDevices(scanner gocql.Scanner, project, accessSite, granularity string) ([]entities.UniqueDevices, error) {
+	var items = make([]entities.UniqueDevices, 0)
 	var devices, offset, underestimate int
 	var timestamp string
 
 	for scanner.Next() {
-		if err = scanner.Scan(&devices, &offset, &underestimate, &timestamp); err != nil {
-			rLogger.Log(logger.ERROR, "Query failed: %s", err)
-			problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
-			ctx.SetStatusCode(http.StatusInternalServerError)
-			ctx.SetBody(problemResp)
+		if err := scanner.Scan(&devices, &offset, &underestimate, &timestamp); err != nil {
+			_ = scanner.Err() // closes the iterator
+			return nil, err
 		}
-		response.Items = append(response.Items, entities.UniqueDevices{
+		items = append(items, entities.UniqueDevices{
 			Project:       project,
 			AccessSite:    accessSite,
 			Granularity:   granularity,
@@ -41,20 +106,145 @@ func (s *UniqueDevicesLogic) ProcessUniqueDevicesLogic(context context.Context,
 			Underestimate: underestimate,
 		})
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
 
-	str := "The date(s) you used are valid, but we either do not have data for those date(s), or the project you asked for is not loaded yet.  Please check documentation for more information."
-	if len(response.Items) == 0 {
-		problemResp := aqsassist.CreateProblem(http.StatusNotFound, str, string(ctx.Request.URI().RequestURI()))
+// ProcessUniqueDevicesPageLogic returns a single page of at most limit rows in a range,
+// resuming from the paging state of a previous page, if any. It also returns the paging
+// state of the next page, which is empty after the last page. Pages are always read from
+// Cassandra, and never cached.
+func (s *UniqueDevicesLogic) ProcessUniqueDevicesPageLogic(context context.Context, ctx *fasthttp.RequestCtx, project, accessSite, granularity, start, end string, limit int, pageState []byte, session *gocql.Session, rLogger *logger.Logger) (*problem.Problem, entities.UniqueDevicesResponse, []byte) {
+	query, err := newQuery(context, session, uniqueDevicesQuery, project, accessSite, granularity, start, end)
+	if err != nil {
+		return QueryProblem(ctx, err, rLogger), entities.UniqueDevicesResponse{}, nil
+	}
+	// Setting the paging state (even to nil) disables automatic paging, so only one page is read
+	iter := query.PageSize(limit).PageState(pageState).Iter()
+	items, err := scanUniqueDevices(iter.Scanner(), project, accessSite, granularity)
+	if err != nil {
+		return QueryProblem(ctx, err, rLogger), entities.UniqueDevicesResponse{}, nil
+	}
+
+	// Only an empty first page means there is no data; later pages may legitimately be empty
+	next := iter.PageState()
+	if len(items) == 0 && len(pageState) == 0 && len(next) == 0 {
+		problemResp := aqsassist.CreateProblem(http.StatusNotFound, NotFoundDetail, string(ctx.Request.URI().RequestURI()))
 		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetBody(problemResp.JSON())
-		return problemResp, entities.UniqueDevicesResponse{}
+		return problemResp, entities.UniqueDevicesResponse{}, nil
 	}
-	if err := scanner.Err(); err != nil {
-		//s.logger.Request(r).Log(logger.ERROR, "Error querying database: %s", err)
-		problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI()))
-		ctx.SetStatusCode(http.StatusInternalServerError)
+	return nil, entities.UniqueDevicesResponse{Items: items}, next
+}
+
+func (s *UniqueDevicesLogic) ProcessLatestUniqueDevicesLogic(context context.Context, ctx *fasthttp.RequestCtx, project, accessSite, granularity string, session *gocql.Session, rLogger *logger.Logger) (*problem.Problem, entities.UniqueDevicesResponse) {
+	item, err := queryLatestUniqueDevices(context, project, accessSite, granularity, session)
+	if err == gocql.ErrNotFound {
+		str := "We do not have data for the project, access method and granularity you asked for.  Please check documentation for more information."
+		problemResp := aqsassist.CreateProblem(http.StatusNotFound, str, string(ctx.Request.URI().RequestURI()))
+		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetBody(problemResp.JSON())
 		return problemResp, entities.UniqueDevicesResponse{}
 	}
-	return problemData, response
+	if err != nil {
+		return QueryProblem(ctx, err, rLogger), entities.UniqueDevicesResponse{}
+	}
+	return nil, entities.UniqueDevicesResponse{Items: []entities.UniqueDevices{item}}
+}
+
+// LatestTimestamp returns the timestamp of the most recent row for a project, access
+// method and granularity, or "" if there is none.
+func (s *UniqueDevicesLogic) LatestTimestamp(context context.Context, project, accessSite, granularity string, session *gocql.Session) (string, error) {
+	item, err := queryLatestUniqueDevices(context, project, accessSite, granularity, session)
+	if err == gocql.ErrNotFound {
+		return "", nil
+	}
+	return item.Timestamp, err
+}
+
+// queryLatestUniqueDevices returns the most recent row for a project, access method and
+// granularity, or gocql.ErrNotFound if there is none.
+func queryLatestUniqueDevices(context context.Context, project, accessSite, granularity string, session *gocql.Session) (entities.UniqueDevices, error) {
+	var devices, offset, underestimate int
+	var timestamp string
+
+	// Read a single row from the end of the partition, rather than scanning all of it
+	query := `SELECT devices, offset, underestimate, timestamp FROM "local_group_default_T_unique_devices".data WHERE "_domain" = 'analytics.wikimedia.org' AND project = ? AND "access-site" = ? AND granularity = ? ORDER BY timestamp DESC LIMIT 1`
+	q, err := newQuery(context, session, query, project, accessSite, granularity)
+	if err == nil {
+		err = q.Scan(&devices, &offset, &underestimate, &timestamp)
+	}
+	if err != nil {
+		return entities.UniqueDevices{}, err
+	}
+
+	return entities.UniqueDevices{
+		Project:       project,
+		AccessSite:    accessSite,
+		Granularity:   granularity,
+		Timestamp:     timestamp,
+		Devices:       devices,
+		Offset:        offset,
+		Underestimate: underestimate,
+	}, nil
+}
+
+// UniqueDevicesStream iterates over unique devices rows as they are read from Cassandra,
+// one page at a time, rather than accumulating them in a response.
+type UniqueDevicesStream struct {
+	project     string
+	accessSite  string
+	granularity string
+	scanner     gocql.Scanner
+	err         error
+}
+
+// StreamUniqueDevices returns a UniqueDevicesStream over the rows in the given range. If
+// the query cannot be made, the stream is empty, and Err returns the reason.
+func (s *UniqueDevicesLogic) StreamUniqueDevices(context context.Context, project, accessSite, granularity, start, end string, session *gocql.Session) *UniqueDevicesStream {
+	stream := &UniqueDevicesStream{
+		project:     project,
+		accessSite:  accessSite,
+		granularity: granularity,
+	}
+	query, err := newQuery(context, session, uniqueDevicesQuery, project, accessSite, granularity, start, end)
+	if err != nil {
+		stream.err = err
+	} else {
+		stream.scanner = query.Iter().Scanner()
+	}
+	return stream
+}
+
+// Next returns the next row in the stream. The boolean result is false once the stream is
+// exhausted, or has failed (see Err).
+func (s *UniqueDevicesStream) Next() (entities.UniqueDevices, bool) {
+	var devices, offset, underestimate int
+	var timestamp string
+
+	if s.err != nil || !s.scanner.Next() {
+		return entities.UniqueDevices{}, false
+	}
+	if s.err = s.scanner.Scan(&devices, &offset, &underestimate, &timestamp); s.err != nil {
+		return entities.UniqueDevices{}, false
+	}
+	return entities.UniqueDevices{
+		Project:       s.project,
+		AccessSite:    s.accessSite,
+		Granularity:   s.granularity,
+		Timestamp:     timestamp,
+		Devices:       devices,
+		Offset:        offset,
+		Underestimate: underestimate,
+	}, true
+}
+
+// Err returns the error, if any, that ended the stream.
+func (s *UniqueDevicesStream) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.scanner.Err()
 }
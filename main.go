@@ -17,13 +17,22 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
-	"unique-devices/configuration"
+	"syscall"
+	"time"
+
+	"device-analytics/cache"
+	"device-analytics/certreload"
+	"device-analytics/configuration"
+	"device-analytics/listener"
+	"device-analytics/logic"
 
 	log "gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
 	fasthttpprom "github.com/carousell/fasthttp-prometheus-middleware"
@@ -60,8 +69,10 @@ func main() {
 	var config *configuration.Config
 	var err error
 	var logger *log.Logger
+	started := time.Now()
 
 	notFoundHandler := &NotFoundHandler{}
+	methodNotAllowedHandler := &MethodNotAllowedHandler{}
 
 	flag.Parse()
 
@@ -90,31 +101,177 @@ func main() {
 		os.Exit(1)
 	}
 
+	policies := queryPolicies(config)
+	logic.SetQueryPolicies(policies)
+
 	// pass bound struct method to fasthttp
+	availabilityTimeout := time.Duration(config.AvailabilityTimeout) * time.Millisecond
+	availabilityLogic := logic.NewAvailabilityLogic(cache.New("availability", config.AvailabilityCacheSize, time.Duration(config.AvailabilityCacheTTL)*time.Second, availabilityTimeout))
+	var responseCache *cache.Cache
+	if config.ResponseCache.Enabled {
+		responseCache = cache.New("unique_devices", config.ResponseCache.Size, time.Duration(config.ResponseCache.TTL)*time.Second, time.Duration(config.ContextTimeout)*time.Millisecond)
+	}
+	uniqueDevicesLogic := logic.NewUniqueDevicesLogic(responseCache, config.Cassandra.CircuitBreaker.ServeStale)
+
+	cursors, err := newCursorSigner(config.CursorSecret)
+	if err != nil {
+		logger.Error("Unable to create a pagination cursor key: %s", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	uniqueDevicesHandler := &UniqueDevicesHandler{
-		logger: logger, session: session, config: config}
+		logger: logger, session: session, config: config, logic: uniqueDevicesLogic, cursors: cursors}
+	availabilityHandler := &AvailabilityHandler{
+		logger: logger, session: session, config: config, logic: availabilityLogic}
+	latestHandler := &LatestHandler{
+		logger: logger, session: session, config: config, logic: uniqueDevicesLogic}
+	projectsHandler := &ProjectsHandler{logger: logger, logic: &logic.ProjectsLogic{}}
+
+	// build the project catalogue in the background, and keep it fresh
+	go projectsHandler.logic.Run(context.Background(), session, time.Duration(config.ProjectsRefreshInterval)*time.Second, logger)
 
 	r := router.New()
 	r.RedirectFixedPath = false
 	r.NotFound = notFoundHandler.HandleFastHTTP
+	r.MethodNotAllowed = methodNotAllowedHandler.HandleFastHTTP
+
+	// Operational endpoints are served on the admin listener if there is one, so that they
+	// are never exposed through the public edge, and on the public listener otherwise
+	adminRouter := r
+	if config.Admin.Enabled() {
+		adminRouter = router.New()
+		adminRouter.RedirectFixedPath = false
+		adminRouter.NotFound = notFoundHandler.HandleFastHTTP
+		adminRouter.MethodNotAllowed = methodNotAllowedHandler.HandleFastHTTP
+	}
+
 	p := fasthttpprom.NewPrometheus("")
 	p.MetricsPath = "/admin/metrics"
-	p.Use(r)
+	p.Use(adminRouter)
 
-	r.GET("/healthz", func(ctx *fasthttp.RequestCtx) {
-		var response []byte
+	adminRouter.GET("/healthz", func(ctx *fasthttp.RequestCtx) {
 		ctx.SetStatusCode(fasthttp.StatusOK)
-		if response, err = json.MarshalIndent(NewHealthz(version, buildDate, buildHost), "", "  "); err != nil {
+		response, err := marshalJSON(ctx, NewHealthz(version, buildDate, buildHost))
+		if err != nil {
 			ctx.SetBody([]byte(`{}`))
 			return
 		}
 		ctx.SetBody(response)
 	})
+	readyzHandler := &ReadyzHandler{logger: logger, session: session, config: config, breaker: policies.Breaker}
+	adminRouter.GET("/readyz", readyzHandler.HandleFastHTTP)
+	buildInfoHandler := &BuildInfoHandler{started: started}
+	adminRouter.GET("/admin/build-info", buildInfoHandler.HandleFastHTTP)
+
+	var servers []*fasthttp.Server
+	if config.Admin.Enabled() {
+		configHandler := &ConfigHandler{config: config}
+		adminRouter.GET("/admin/config", configHandler.HandleFastHTTP)
+		if responseCache != nil {
+			cacheHandler := &CacheHandler{logger: logger, cache: responseCache}
+			adminRouter.POST("/admin/cache/purge", cacheHandler.HandleFastHTTP)
+		}
+		if config.Pprof.Enabled {
+			registerPprof(adminRouter, config)
+		}
+
+		adminServer := newServer(config, Pipeline(config, adminRouter.Handler))
+		adminAddress := config.Admin.ListenAddress()
+		adminListener, err := listener.Listen(adminAddress, config.SocketFileMode())
+		if err != nil {
+			logger.Error("Unable to listen on %s: %s", adminAddress, err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		logger.Info("Serving admin endpoints on %s", adminAddress)
+		servers = append(servers, adminServer)
+		go func() {
+			if err := adminServer.Serve(adminListener); err != nil {
+				logger.Error("Admin listener on %s failed: %s", adminAddress, err)
+			}
+		}()
+	}
+
+	// Middleware for API routes only (see Pipeline for the middleware applied to every response)
+	middlewares := []middleware.Middleware{}
+	if config.CORS.Enabled {
+		// Preflight requests are answered before they count against the rate limit
+		middlewares = append(middlewares, CORSMiddleware(config))
+	}
+	if config.RateLimit.Enabled {
+		middlewares = append(middlewares, RateLimitMiddleware(config))
+	}
+	midAccessGroup := middleware.New(middlewares)
 
-	midAccessGroup := middleware.New([]middleware.Middleware{SetContentType, SecureHeadersMiddleware})
+	routes := map[string]fasthttp.RequestHandler{
+		"/projects": projectsHandler.HandleFastHTTP,
+		"/{project}/{access-site}/{granularity}/{start}/{end}": uniqueDevicesHandler.HandleFastHTTP,
+		"/{project}/{access-site}/{granularity}/availability":  availabilityHandler.HandleFastHTTP,
+		"/{project}/{access-site}/{granularity}/latest":        latestHandler.HandleFastHTTP,
+	}
+	for route, routeHandler := range routes {
+		r.GET(path.Join(config.BaseURI, route), midAccessGroup(routeHandler))
+		if config.CORS.Enabled {
+			r.OPTIONS(path.Join(config.BaseURI, route), midAccessGroup(OptionsHandler))
+		}
+	}
 
-	r.GET(path.Join(config.BaseURI, "/{project}/{access-site}/{granularity}/{start}/{end}"), midAccessGroup(uniqueDevicesHandler.HandleFastHTTP))
+	server := newServer(config, Pipeline(config, r.Handler))
+	servers = append(servers, server)
+	address := config.ListenAddress()
 
-	err = fasthttp.ListenAndServe(fmt.Sprintf("%s:%d", config.Address, config.Port), r.Handler)
-	logger.Info(err.Error())
+	ln, err := listener.Listen(address, config.SocketFileMode())
+	if err != nil {
+		logger.Error("Unable to listen on %s: %s", address, err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if config.TLS.Enabled() {
+		reloader, err := certreload.New(config.TLS.Cert, config.TLS.Key)
+		if err != nil {
+			logger.Error("Unable to load TLS certificate: %s", err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		go reloader.Run(context.Background(), time.Duration(config.TLS.ReloadInterval)*time.Second, logger)
+
+		tlsConfig, err := newTLSConfig(config, reloader)
+		if err != nil {
+			logger.Error("Invalid TLS configuration: %s", err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		shutdownOnSignal(logger, servers...)
+		close(shutdown)
+	}()
+
+	logger.Info("Serving on %s", address)
+	if err = server.Serve(ln); err != nil {
+		logger.Error("Listener on %s failed: %s", address, err)
+		os.Exit(1)
+	}
+	// Serve returns as soon as the listener is closed, before open connections are drained
+	<-shutdown
+	logger.Info("Shut down")
+}
+
+// shutdownOnSignal gracefully shuts down servers on SIGINT or SIGTERM, waiting for open
+// connections to close (and removing any Unix domain sockets they listen on).
+func shutdownOnSignal(logger *log.Logger, servers ...*fasthttp.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	logger.Info("Received %s, shutting down", sig)
+	for _, server := range servers {
+		if err := server.Shutdown(); err != nil {
+			logger.Error("Unable to shut down: %s", err)
+		}
+	}
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+)
+
+// MethodNotAllowedHandler is the HTTP handler when a route matches, but not the request
+// method. The router sets the Allow header before calling it.
+type MethodNotAllowedHandler struct {
+}
+
+func (s *MethodNotAllowedHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	detail := "Method not allowed, must be one of: " + string(ctx.Response.Header.Peek("Allow"))
+	problemResp := aqsassist.CreateProblem(http.StatusMethodNotAllowed, detail, string(ctx.Request.URI().RequestURI())).JSON()
+	ctx.SetStatusCode(http.StatusMethodNotAllowed)
+	ctx.SetBody(problemResp)
+}
@@ -1,9 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+
+	"device-analytics/configuration"
+
+	"github.com/roger-russel/fasthttp-router-middleware/pkg/middleware"
 	"github.com/valyala/fasthttp"
 )
 
+// Pipeline returns handler wrapped in the middleware applied to every response of a
+// listener, whatever the route (including 404s and 405s).
+func Pipeline(config *configuration.Config, handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	handler = middleware.New([]middleware.Middleware{SetContentType})(handler)
+	handler = ProblemContentTypeMiddleware(handler)
+	handler = ConditionalGetMiddleware(handler)
+	handler = CompressMiddleware(config)(handler)
+	return SecurityHeadersMiddleware(config)(handler)
+}
+
 // Set content type as application/json
 func SetContentType(ctx *fasthttp.RequestCtx) bool {
 	ctx.SetContentType("application/json; charset=utf-8")
@@ -11,12 +27,58 @@ func SetContentType(ctx *fasthttp.RequestCtx) bool {
 
 }
 
-// SecureHeadersMiddleware adds two basic security headers to each HTTP response
-// X-XSS-Protection: 1; mode-block can help to prevent XSS attacks
-// X-Frame-Options: deny can help to prevent clickjacking attacks
-func SecureHeadersMiddleware(ctx *fasthttp.RequestCtx) bool {
-	ctx.Response.Header.Set("X-XSS-Protection", "1; mode-block")
-	ctx.Response.Header.Set("X-Frame-Options", "deny")
-	return true
+// ProblemContentTypeMiddleware serves error responses, whose bodies are always problem
+// details (see aqsassist.CreateProblem), as application/problem+json rather than the
+// default application/json.
+func ProblemContentTypeMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		next(ctx)
+
+		if ctx.Response.StatusCode() >= fasthttp.StatusBadRequest && bytes.HasPrefix(ctx.Response.Header.ContentType(), []byte("application/json")) {
+			ctx.SetContentType("application/problem+json")
+		}
+	}
+}
+
+// SecurityHeadersMiddleware returns middleware that adds the configured security headers
+// to every response (a header configured as empty is omitted):
+//   - Content-Security-Policy, restricting what a response may load or be framed by
+//   - X-Content-Type-Options: nosniff, preventing browsers from guessing content types
+//   - X-Frame-Options, for browsers that predate CSP frame-ancestors
+//   - Referrer-Policy
+//   - Cross-Origin-Resource-Policy
+//   - Strict-Transport-Security, on requests made over TLS (directly, or to a proxy that
+//     sets X-Forwarded-Proto)
+//
+// The headers are set before the handler runs, so handlers may override them.
+func SecurityHeadersMiddleware(config *configuration.Config) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
+	headers := config.SecurityHeaders
+	hsts := ""
+	if headers.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", headers.HSTSMaxAge)
+		if headers.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			setHeader(ctx, "Content-Security-Policy", headers.ContentSecurityPolicy)
+			setHeader(ctx, "X-Content-Type-Options", "nosniff")
+			setHeader(ctx, "X-Frame-Options", headers.FrameOptions)
+			setHeader(ctx, "Referrer-Policy", headers.ReferrerPolicy)
+			setHeader(ctx, "Cross-Origin-Resource-Policy", headers.CrossOriginResourcePolicy)
+			if ctx.IsTLS() || string(ctx.Request.Header.Peek("X-Forwarded-Proto")) == "https" {
+				setHeader(ctx, "Strict-Transport-Security", hsts)
+			}
+			next(ctx)
+		}
+	}
+}
 
+// setHeader sets a response header, unless value is empty.
+func setHeader(ctx *fasthttp.RequestCtx, name, value string) {
+	if value != "" {
+		ctx.Response.Header.Set(name, value)
+	}
 }
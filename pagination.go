@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+	"schneider.vip/problem"
+)
+
+// Page sizes for cursor pagination
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// Length of the MAC at the start of a cursor
+const cursorMACSize = 16
+
+// invalidCursorDetail is the problem detail for cursors that can't be decoded, or that
+// don't belong to the request they were sent with.
+const invalidCursorDetail = "cursor is invalid, it must be the cursor of a next link given in a previous response"
+
+// cursorSigner turns Cassandra paging states into cursors, and back. A cursor is the
+// paging state prefixed with a MAC of it and of the query it continues, so that only
+// cursors given in next links, and only for the query they came from, reach Cassandra.
+type cursorSigner struct {
+	key []byte
+}
+
+// newCursorSigner returns a cursorSigner keyed with secret, or with a random key if secret
+// is empty (in which case cursors are only valid on this instance, until it restarts).
+func newCursorSigner(secret string) (*cursorSigner, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &cursorSigner{key: key}, nil
+}
+
+// sign returns the cursor for pageState, for the query identified by the given parameters.
+func (s *cursorSigner) sign(pageState []byte, query ...string) []byte {
+	return append(s.mac(pageState, query), pageState...)
+}
+
+// open returns the paging state of cursor, if it was signed for the query identified by
+// the given parameters. The boolean result is false otherwise.
+func (s *cursorSigner) open(cursor []byte, query ...string) ([]byte, bool) {
+	if len(cursor) <= cursorMACSize {
+		return nil, false
+	}
+	pageState := cursor[cursorMACSize:]
+	if !hmac.Equal(cursor[:cursorMACSize], s.mac(pageState, query)) {
+		return nil, false
+	}
+	return pageState, true
+}
+
+func (s *cursorSigner) mac(pageState []byte, query []string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	for _, param := range query {
+		mac.Write([]byte(param))
+		mac.Write([]byte{0})
+	}
+	mac.Write(pageState)
+	return mac.Sum(nil)[:cursorMACSize]
+}
+
+// pageParams returns the limit and the decoded (but not yet verified) cursor of a paginated
+// request, or a limit of 0 if the request gave neither a limit nor a cursor, and is not
+// paginated. On failure, the problem is set on the response and returned.
+func pageParams(ctx *fasthttp.RequestCtx) (int, []byte, *problem.Problem) {
+	limitParam := string(ctx.QueryArgs().Peek("limit"))
+	cursorParam := string(ctx.QueryArgs().Peek("cursor"))
+	if limitParam == "" && cursorParam == "" {
+		return 0, nil, nil
+	}
+
+	var err error
+	limit := defaultPageLimit
+	if limitParam != "" {
+		if limit, err = strconv.Atoi(limitParam); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, nil, setPageProblem(ctx, "limit is invalid, must be an integer from 1 to "+strconv.Itoa(maxPageLimit))
+		}
+	}
+
+	var cursor []byte
+	if cursorParam != "" {
+		if cursor, err = base64.RawURLEncoding.DecodeString(cursorParam); err != nil || len(cursor) <= cursorMACSize {
+			return 0, nil, setPageProblem(ctx, invalidCursorDetail)
+		}
+	}
+	return limit, cursor, nil
+}
+
+func setPageProblem(ctx *fasthttp.RequestCtx, detail string) *problem.Problem {
+	problemResp := aqsassist.CreateProblem(http.StatusBadRequest, detail, string(ctx.Request.URI().RequestURI()))
+	ctx.SetStatusCode(http.StatusBadRequest)
+	ctx.SetBody(problemResp.JSON())
+	return problemResp
+}
+
+// pageURI returns the URI of the request with the start and end path parameters replaced,
+// and the given cursor (or no cursor, for the first page of a range).
+func pageURI(ctx *fasthttp.RequestCtx, start, end string, cursor []byte) string {
+	segments := strings.Split(string(ctx.Path()), "/")
+	segments[len(segments)-2], segments[len(segments)-1] = start, end
+	path := strings.Join(segments, "/")
+
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+	ctx.QueryArgs().CopyTo(args)
+	args.Del("cursor")
+	if len(cursor) > 0 {
+		args.Set("cursor", base64.RawURLEncoding.EncodeToString(cursor))
+	}
+	if args.Len() == 0 {
+		return path
+	}
+	return path + "?" + args.String()
+}
+
+// setLinkNext sets the Link header to the URI of the next page, if there is one.
+func setLinkNext(ctx *fasthttp.RequestCtx, next string) {
+	if next != "" {
+		ctx.Response.Header.Set("Link", "<"+next+`>; rel="next"`)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strconv"
+	"time"
+
+	"device-analytics/configuration"
+
+	"github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+)
+
+// registerPprof adds the pprof endpoints to r (which should be the admin router), and
+// enables the mutex and block profiles at the configured rates.
+//   - /debug/pprof/ lists the profiles, and /debug/pprof/{profile} serves one (heap,
+//     goroutine, mutex, block, allocs or threadcreate)
+//   - /debug/pprof/profile?seconds=N records a CPU profile (see CPUProfileHandler)
+//   - /debug/pprof/cmdline and /debug/pprof/symbol support go tool pprof
+func registerPprof(r *router.Router, config *configuration.Config) {
+	runtime.SetMutexProfileFraction(config.Pprof.MutexProfileFraction)
+	runtime.SetBlockProfileRate(config.Pprof.BlockProfileRate)
+
+	cpuProfileHandler := &CPUProfileHandler{config: config}
+	r.GET("/debug/pprof/", fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Index))
+	r.GET("/debug/pprof/{profile}", fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Index))
+	r.GET("/debug/pprof/profile", cpuProfileHandler.HandleFastHTTP)
+	r.GET("/debug/pprof/cmdline", fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Cmdline))
+	r.GET("/debug/pprof/symbol", fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Symbol))
+	r.POST("/debug/pprof/symbol", fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Symbol))
+}
+
+// CPUProfileHandler is the HTTP handler that records a CPU profile for the number of
+// seconds requested (30 by default), up to the configured maximum, and returns it.
+type CPUProfileHandler struct {
+	config *configuration.Config
+}
+
+func (s *CPUProfileHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	seconds := 30
+	if param := string(ctx.QueryArgs().Peek("seconds")); param != "" {
+		var err error
+		if seconds, err = strconv.Atoi(param); err != nil || seconds < 1 {
+			problemResp := aqsassist.CreateProblem(http.StatusBadRequest, "seconds is invalid, must be a positive integer", string(ctx.Request.URI().RequestURI())).JSON()
+			ctx.SetStatusCode(http.StatusBadRequest)
+			ctx.SetBody(problemResp)
+			return
+		}
+	}
+	if seconds > s.config.Pprof.MaxProfileSeconds {
+		seconds = s.config.Pprof.MaxProfileSeconds
+	}
+
+	var profile bytes.Buffer
+	if err := rpprof.StartCPUProfile(&profile); err != nil {
+		// Only one CPU profile can be recorded at a time
+		problemResp := aqsassist.CreateProblem(http.StatusConflict, "Unable to start CPU profile: "+err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusConflict)
+		ctx.SetBody(problemResp)
+		return
+	}
+	timer := time.NewTimer(time.Duration(seconds) * time.Second)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+	}
+	rpprof.StopCPUProfile()
+
+	ctx.SetContentType("application/octet-stream")
+	ctx.Response.Header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cpu-%s.pprof"`, time.Now().UTC().Format("20060102T150405Z")))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(profile.Bytes())
+}
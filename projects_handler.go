@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+
+	"device-analytics/logic"
+
+	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+)
+
+// ProjectsHandler is the HTTP handler for project catalogue requests.
+type ProjectsHandler struct {
+	logger *logger.Logger
+	logic  *logic.ProjectsLogic
+}
+
+// API documentation
+// @summary      List the projects for which unique devices data is available
+// @router       /unique-devices/projects  [get]
+// @description  Returns every project with unique devices data, with its domain, family, language and the range of data available per granularity.
+// @produce      json
+// @success      200  {object}  entities.ProjectsResponse
+// @success      304
+func (s *ProjectsHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	var err error
+
+	catalogue, etag, updated := s.logic.Catalogue()
+	if catalogue == nil {
+		problemResp := aqsassist.CreateProblem(http.StatusServiceUnavailable, "The project catalogue is not available yet, please try again later", string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusServiceUnavailable)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	ctx.Response.Header.Set("ETag", etag)
+	ctx.Response.Header.SetLastModified(updated)
+
+	if etagMatches(string(ctx.Request.Header.Peek("If-None-Match")), etag) {
+		ctx.SetStatusCode(fasthttp.StatusNotModified)
+		return
+	}
+
+	var data []byte
+	if data, err = marshalJSON(ctx, catalogue); err != nil {
+		s.logger.Log(logger.ERROR, "Unable to marshal response object: %s", err)
+		problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(data)
+}
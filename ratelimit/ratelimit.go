@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a set of token buckets, one per client key. Each bucket holds up to burst
+// tokens and refills at rate tokens per second; every request takes one token.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Result describes the outcome of a call to Allow.
+type Result struct {
+	Allowed    bool          // Whether the request may proceed
+	Limit      int           // Bucket capacity
+	Remaining  int           // Tokens left in the bucket
+	RetryAfter time.Duration // Time until a token is available (zero when Allowed)
+	Reset      time.Duration // Time until the bucket is full again
+}
+
+// New returns a Limiter allowing rate requests per second, with bursts of up to burst.
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from the bucket for key, if one is available at time now.
+func (l *Limiter) Allow(key string, now time.Time) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	result := Result{Limit: int(l.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = l.duration(1 - b.tokens)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = l.duration(l.burst - b.tokens)
+	return result
+}
+
+// duration returns the time needed to refill n tokens.
+func (l *Limiter) duration(n float64) time.Duration {
+	return time.Duration(n / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that have had time to refill completely, since they are
+// indistinguishable from new ones; it runs at most once per refill period. Must be
+// called with mu held.
+func (l *Limiter) sweep(now time.Time) {
+	full := l.duration(l.burst)
+	if now.Sub(l.swept) < full {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
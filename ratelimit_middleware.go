@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"device-analytics/configuration"
+	"device-analytics/ratelimit"
+
+	"github.com/valyala/fasthttp"
+	"gitlab.wikimedia.org/frankie/aqsassist"
+)
+
+// RateLimitMiddleware returns middleware that limits each client to the configured rate
+// (with bursts), rejecting excess requests with a 429 problem response. Clients are
+// identified by the configured header if present in a request from a trusted proxy, or by
+// IP address otherwise; clients in the allowlists are never limited.
+func RateLimitMiddleware(config *configuration.Config) func(ctx *fasthttp.RequestCtx) bool {
+	limiter := ratelimit.New(config.RateLimit.Rate, config.RateLimit.Burst)
+
+	allowedNets := parseNets(config.RateLimit.AllowedIPs)
+	trustedProxies := parseNets(config.RateLimit.TrustedProxies)
+	allowedClients := make(map[string]bool)
+	for _, client := range config.RateLimit.AllowedClients {
+		allowedClients[client] = true
+	}
+
+	return func(ctx *fasthttp.RequestCtx) bool {
+		ip := ctx.RemoteIP()
+		if containsIP(allowedNets, ip) {
+			return true
+		}
+
+		key := "ip:" + ip.String()
+		if config.RateLimit.ClientHeader != "" && containsIP(trustedProxies, ip) {
+			if client := string(ctx.Request.Header.Peek(config.RateLimit.ClientHeader)); client != "" {
+				if allowedClients[client] {
+					return true
+				}
+				key = "client:" + client
+			}
+		}
+
+		result := limiter.Allow(key, time.Now())
+		ctx.Response.Header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		ctx.Response.Header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		ctx.Response.Header.Set("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+		if result.Allowed {
+			return true
+		}
+
+		retryAfter := seconds(result.RetryAfter)
+		detail := fmt.Sprintf("Request rate limit exceeded, please retry after %d second(s)", retryAfter)
+		problemResp := aqsassist.CreateProblem(http.StatusTooManyRequests, detail, string(ctx.Request.URI().RequestURI())).JSON()
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(retryAfter))
+		ctx.SetStatusCode(http.StatusTooManyRequests)
+		ctx.SetBody(problemResp)
+		return false
+	}
+}
+
+// parseNets parses IP addresses and networks (in CIDR notation), skipping invalid ones.
+func parseNets(addresses []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			bits := len(ip) * 8
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else if _, ipNet, err := net.ParseCIDR(address); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
+// containsIP reports whether ip is in any of nets.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// seconds rounds d up to a whole number of seconds.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"time"
+
+	"device-analytics/configuration"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newServer returns a fasthttp.Server for handler, tuned as configured.
+func newServer(config *configuration.Config, handler fasthttp.RequestHandler) *fasthttp.Server {
+	settings := config.Server
+	return &fasthttp.Server{
+		Handler:            handler,
+		Name:               settings.Name,
+		ReadTimeout:        time.Duration(settings.ReadTimeout) * time.Millisecond,
+		WriteTimeout:       time.Duration(settings.WriteTimeout) * time.Millisecond,
+		IdleTimeout:        time.Duration(settings.IdleTimeout) * time.Millisecond,
+		Concurrency:        settings.Concurrency,
+		MaxConnsPerIP:      settings.MaxConnsPerIP,
+		MaxRequestsPerConn: settings.MaxRequestsPerConn,
+		MaxRequestBodySize: settings.MaxRequestBodySize,
+		ReadBufferSize:     settings.ReadBufferSize,
+		ReduceMemoryUsage:  settings.ReduceMemoryUsage,
+	}
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"device-analytics/breaker"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBreaker(name string) *breaker.Breaker {
+	return breaker.New(name, breaker.Settings{
+		Window:      10 * time.Second,
+		MinRequests: 4,
+		ErrorRate:   0.5,
+		OpenFor:     5 * time.Second,
+	})
+}
+
+func TestBreakerOpens(t *testing.T) {
+	b := newBreaker("test_opens")
+	now := time.Now()
+
+	// Too few requests to open, however many failed
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.Allow(now))
+		b.Record(now, true)
+	}
+	assert.Equal(t, breaker.Closed, b.State())
+
+	require.NoError(t, b.Allow(now))
+	b.Record(now, false)
+	assert.Equal(t, breaker.Open, b.State())
+
+	err := b.Allow(now.Add(time.Second))
+	require.Error(t, err)
+	open, ok := err.(*breaker.OpenError)
+	require.True(t, ok)
+	assert.Equal(t, 4*time.Second, open.RetryAfter)
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	b := newBreaker("test_error_rate")
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		b.Record(now, i >= 6)
+	}
+	assert.Equal(t, breaker.Closed, b.State())
+}
+
+func TestBreakerWindow(t *testing.T) {
+	b := newBreaker("test_window")
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		b.Record(now, true)
+	}
+	// The earlier failures have left the window
+	b.Record(now.Add(11*time.Second), true)
+	assert.Equal(t, breaker.Closed, b.State())
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b := newBreaker("test_half_open")
+	now := time.Now()
+
+	for i := 0; i < 4; i++ {
+		b.Record(now, true)
+	}
+	require.Equal(t, breaker.Open, b.State())
+
+	// A single probe is let through once the breaker has been open long enough
+	now = now.Add(5 * time.Second)
+	require.NoError(t, b.Allow(now))
+	assert.Equal(t, breaker.HalfOpen, b.State())
+	assert.Error(t, b.Allow(now))
+
+	// A failed probe opens the breaker again
+	b.Record(now, true)
+	assert.Equal(t, breaker.Open, b.State())
+	assert.Error(t, b.Allow(now.Add(time.Second)))
+
+	// A successful probe closes it
+	now = now.Add(5 * time.Second)
+	require.NoError(t, b.Allow(now))
+	b.Record(now, false)
+	assert.Equal(t, breaker.Closed, b.State())
+	assert.NoError(t, b.Allow(now))
+}
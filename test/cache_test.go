@@ -0,0 +1,204 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"device-analytics/cache"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loader(value interface{}, calls *int32) func(context.Context) (interface{}, error) {
+	return func(context.Context) (interface{}, error) {
+		atomic.AddInt32(calls, 1)
+		return value, nil
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	var calls int32
+	c := cache.New("test_hit", 10, time.Minute, time.Second)
+
+	for i := 0; i < 3; i++ {
+		value, err := c.Get(context.Background(), "key", loader("value", &calls))
+		require.NoError(t, err)
+		assert.Equal(t, "value", value)
+	}
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	var calls int32
+	c := cache.New("test_expiry", 10, time.Millisecond, time.Second)
+
+	_, err := c.Get(context.Background(), "key", loader("value", &calls))
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = c.Get(context.Background(), "key", loader("value", &calls))
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestCacheEviction(t *testing.T) {
+	var calls int32
+	c := cache.New("test_eviction", 2, time.Minute, time.Second)
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		_, err := c.Get(context.Background(), key, loader(key, &calls))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, int32(3), calls)
+
+	// b was least recently used, so was evicted to make room for c
+	_, err := c.Get(context.Background(), "a", loader("a", &calls))
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), calls)
+	_, err = c.Get(context.Background(), "b", loader("b", &calls))
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), calls)
+}
+
+func TestCacheErrorsNotCached(t *testing.T) {
+	var calls int32
+	c := cache.New("test_errors", 10, time.Minute, time.Second)
+	failure := errors.New("failure")
+
+	_, err := c.Get(context.Background(), "key", func(context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, failure
+	})
+	assert.Equal(t, failure, err)
+
+	value, err := c.Get(context.Background(), "key", loader("value", &calls))
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	var calls int32
+	c := cache.New("test_coalescing", 10, time.Minute, time.Second)
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.Get(context.Background(), "key", func(context.Context) (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "value", nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "value", value)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestCacheCoalescedDeadlines(t *testing.T) {
+	var calls int32
+	c := cache.New("test_coalesced_deadlines", 10, time.Minute, time.Second)
+	release := make(chan struct{})
+	load := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		_, ok := ctx.Deadline()
+		assert.True(t, ok, "Load not bounded by the cache's timeout")
+		<-release
+		return "value", nil
+	}
+
+	// The first caller gives up, without failing the load it started
+	short, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err := c.Get(short, "key", load)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		value, err := c.Get(context.Background(), "key", load)
+		assert.NoError(t, err)
+		assert.Equal(t, "value", value)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	<-done
+
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestCachePurge(t *testing.T) {
+	var calls int32
+	c := cache.New("test_purge", 10, time.Minute, time.Second)
+
+	for _, key := range []string{"en.wikipedia/a", "en.wikipedia/b", "de.wikipedia/a"} {
+		_, err := c.Get(context.Background(), key, loader(key, &calls))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 2, c.Purge("en.wikipedia/"))
+	assert.Equal(t, 1, c.Len())
+	assert.Equal(t, 1, c.Purge(""))
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, 0, c.Purge(fmt.Sprintf("%s/", "fr.wikipedia")))
+}
+
+func TestCacheGetStale(t *testing.T) {
+	var calls int32
+	c := cache.New("test_stale", 10, time.Millisecond, time.Second)
+
+	_, ok := c.GetStale("key")
+	assert.False(t, ok)
+
+	_, err := c.Get(context.Background(), "key", loader("value", &calls))
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	// A failed load leaves the expired value in place
+	_, err = c.Get(context.Background(), "key", func(context.Context) (interface{}, error) { return nil, errors.New("failed") })
+	require.Error(t, err)
+	value, ok := c.GetStale("key")
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+}
+
+func TestCacheBypass(t *testing.T) {
+	var calls int32
+	c := cache.New("test_bypass", 10, time.Minute, time.Minute)
+
+	_, err := c.Get(context.Background(), "key", loader("cached", &calls))
+	require.NoError(t, err)
+
+	// A bypassing caller's deadline reaches the load, and its value is not cached
+	ctx, cancel := context.WithTimeout(cache.Bypass(context.Background()), 50*time.Millisecond)
+	defer cancel()
+	expected, _ := ctx.Deadline()
+	value, err := c.Get(ctx, "key", func(load context.Context) (interface{}, error) {
+		deadline, ok := load.Deadline()
+		assert.True(t, ok)
+		assert.Equal(t, expected, deadline)
+		return "bypassed", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "bypassed", value)
+
+	value, err = c.Get(context.Background(), "key", loader("reloaded", &calls))
+	require.NoError(t, err)
+	assert.Equal(t, "cached", value)
+	assert.Equal(t, int32(1), calls)
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"device-analytics/certreload"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes a self-signed certificate for name, and its key, to dir, with
+// the given modification time.
+func writeCertificate(t *testing.T, dir, name string, modTime time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, r *certreload.Reloader) string {
+	certificate, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certreload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	certFile, keyFile := writeCertificate(t, dir, "first", now.Add(-time.Minute))
+	r, err := certreload.New(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, r))
+
+	reloaded, err := r.Reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded, "Reloaded unchanged files")
+
+	writeCertificate(t, dir, "second", now)
+	reloaded, err = r.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded, "Did not reload changed files")
+	assert.Equal(t, "second", commonName(t, r))
+}
+
+func TestCertificateReloadKeepsCurrentOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certreload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	certFile, keyFile := writeCertificate(t, dir, "current", now.Add(-time.Minute))
+	r, err := certreload.New(certFile, keyFile)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("not a key"), 0600))
+	require.NoError(t, os.Chtimes(keyFile, now, now))
+	_, err = r.Reload()
+	require.Error(t, err)
+	assert.Equal(t, "current", commonName(t, r))
+}
+
+func TestCertificateMissing(t *testing.T) {
+	_, err := certreload.New("/nonexistent/tls.crt", "/nonexistent/tls.key")
+	require.Error(t, err)
+}
@@ -1,7 +1,9 @@
 package test
 
 import (
+	"crypto/tls"
 	"fmt"
+	"os"
 	"strings"
 	"testing"
 
@@ -22,10 +24,54 @@ func TestDefaults(t *testing.T) {
 	assert.Equal(t, "localhost", config.Address)
 	assert.Equal(t, 8080, config.Port)
 	assert.Equal(t, "info", strings.ToLower(config.LogLevel))
+	assert.Equal(t, 30000, config.StreamTimeout)
+	assert.Equal(t, "X-Request-Timeout", config.DeadlineHeader)
+	assert.Equal(t, 300, config.AvailabilityCacheTTL)
+	assert.Equal(t, 10000, config.AvailabilityCacheSize)
+	assert.Equal(t, 1000, config.AvailabilityTimeout)
+	assert.Equal(t, 3600, config.ProjectsRefreshInterval)
+	assert.True(t, config.Compression.Enabled)
+	assert.Equal(t, 1024, config.Compression.MinSize)
+	assert.Equal(t, 300, config.CacheControl.NotFoundMaxAge)
+	assert.True(t, config.ResponseCache.Enabled)
+	assert.Equal(t, 10000, config.ResponseCache.Size)
+	assert.Equal(t, 300, config.ResponseCache.TTL)
+	assert.False(t, config.RateLimit.Enabled)
+	assert.Equal(t, 10.0, config.RateLimit.Rate)
+	assert.Equal(t, 50, config.RateLimit.Burst)
+	assert.Equal(t, "localhost:8080", config.ListenAddress())
+	assert.Equal(t, os.FileMode(0660), config.SocketFileMode())
+	assert.Equal(t, 10000, config.Server.ReadTimeout)
+	assert.Equal(t, 60000, config.Server.WriteTimeout)
+	assert.Equal(t, 60000, config.Server.IdleTimeout)
+	assert.Equal(t, 0, config.Server.Concurrency)
+	assert.Equal(t, "", config.Server.Name)
+	assert.False(t, config.Admin.Enabled())
+	assert.False(t, config.Pprof.Enabled)
+	assert.Equal(t, 60, config.Pprof.MaxProfileSeconds)
+	assert.False(t, config.TLS.Enabled())
+	assert.Equal(t, "1.2", config.TLS.MinVersion)
+	assert.Equal(t, 60, config.TLS.ReloadInterval)
+	assert.False(t, config.RangeLimits.Paginate)
+	assert.False(t, config.CORS.Enabled)
+	assert.Equal(t, []string{"*"}, config.CORS.AllowedOrigins)
+	assert.Equal(t, 86400, config.CORS.MaxAge)
+	assert.Equal(t, "no-referrer", config.SecurityHeaders.ReferrerPolicy)
+	assert.Equal(t, "same-origin", config.SecurityHeaders.CrossOriginResourcePolicy)
+	assert.Equal(t, 31536000, config.SecurityHeaders.HSTSMaxAge)
+	assert.Equal(t, 0, config.RangeLimits.Limit("all-sites", "daily"))
+	assert.Equal(t, 31536000, config.CacheControl.Policy("daily").PastMaxAge)
+	assert.Equal(t, 3600, config.CacheControl.Policy("daily").CurrentMaxAge)
+	assert.Equal(t, 3600, config.CacheControl.Policy("monthly").CurrentMaxAge)
+	assert.Equal(t, 300, config.CacheControl.Policy("hourly").CurrentMaxAge)
 	assert.Equal(t, 9042, config.Cassandra.Port)
 	assert.Equal(t, "quorum", strings.ToLower(config.Cassandra.Consistency))
 	assert.Len(t, config.Cassandra.Hosts, 1)
 	assert.Equal(t, "localhost", config.Cassandra.Hosts[0])
+	assert.Equal(t, 0, config.Cassandra.SpeculativeExecution.Attempts)
+	assert.Equal(t, 0, config.Cassandra.Retry.NumRetries)
+	assert.False(t, config.Cassandra.CircuitBreaker.Enabled)
+	assert.Equal(t, 0.5, config.Cassandra.CircuitBreaker.ErrorRate)
 }
 
 func TestFullConfig(t *testing.T) {
@@ -37,6 +83,72 @@ base_uri: /v1
 listen_address: 127.0.0.5
 listen_port: 8081
 log_level: debug
+server:
+    name: device-analytics
+    write_timeout: 0
+    concurrency: 1000
+    max_conns_per_ip: 10
+    reduce_memory_usage: true
+admin:
+    listen_address: 127.0.0.8
+    listen_port: 9090
+pprof:
+    enabled: true
+    max_profile_seconds: 10
+    block_profile_rate: 0
+tls:
+    cert: /etc/tls/server.crt
+    key: /etc/tls/server.key
+    client_ca: /etc/tls/ca.crt
+    min_version: "1.3"
+stream_timeout: 60000
+deadline_header: X-Deadline-Ms
+availability_cache_ttl: 60
+cursor_secret: s3cret
+availability_cache_size: 100
+availability_timeout: 500
+projects_refresh_interval: 600
+compression:
+    enabled: false
+    min_size: 256
+cache_control:
+    not_found_max_age: 60
+    daily:
+        past_max_age: 86400
+        current_max_age: 600
+response_cache:
+    size: 100
+    ttl: 60
+rate_limit:
+    enabled: true
+    rate: 2.5
+    burst: 5
+    client_header: X-Client-ID
+    trusted_proxies:
+        - 10.1.2.3
+    allowed_ips:
+        - 10.0.0.0/8
+        - 127.0.0.1
+    allowed_clients:
+        - internal
+range_limits:
+    paginate: true
+    hourly: 168
+    daily: 1100
+    access_sites:
+        all-sites:
+            hourly: 720
+cors:
+    enabled: true
+    allowed_origins:
+        - https://dashboards.example.org
+    allowed_headers: [Accept]
+    max_age: 600
+security_headers:
+    content_security_policy: ""
+    cross_origin_resource_policy: cross-origin
+    hsts_max_age: 600
+    hsts_include_subdomains: true
 cassandra:
     port: 9043
     consistency: localQuorum
@@ -44,6 +156,19 @@ cassandra:
         - 127.0.0.6
         - 127.0.0.7
     local_dc: datacenter1
+    speculative_execution:
+        attempts: 2
+        delay: 5
+    retry:
+        num_retries: 3
+        max_backoff: 20
+    circuit_breaker:
+        enabled: true
+        window: 30
+        min_requests: 5
+        error_rate: 0.25
+        open_duration: 10
+        serve_stale: true
 `
 config, err = configuration.NewConfig([]byte(conf))
 	require.NoError(t, err)
@@ -53,12 +178,83 @@ config, err = configuration.NewConfig([]byte(conf))
 	assert.Equal(t, "127.0.0.5", config.Address)
 	assert.Equal(t, 8081, config.Port)
 	assert.Equal(t, "debug", strings.ToLower(config.LogLevel))
+	assert.Equal(t, 60000, config.StreamTimeout)
+	assert.Equal(t, "X-Deadline-Ms", config.DeadlineHeader)
+	assert.Equal(t, "127.0.0.5:8081", config.ListenAddress())
+	assert.Equal(t, "device-analytics", config.Server.Name)
+	assert.Equal(t, 10000, config.Server.ReadTimeout)
+	assert.Equal(t, 0, config.Server.WriteTimeout)
+	assert.Equal(t, 1000, config.Server.Concurrency)
+	assert.Equal(t, 10, config.Server.MaxConnsPerIP)
+	assert.True(t, config.Server.ReduceMemoryUsage)
+	assert.True(t, config.Admin.Enabled())
+	assert.Equal(t, "127.0.0.8:9090", config.Admin.ListenAddress())
+	assert.Equal(t, "127.0.0.8", config.Admin.Address)
+	assert.Equal(t, 9090, config.Admin.Port)
+	assert.True(t, config.Pprof.Enabled)
+	assert.Equal(t, 10, config.Pprof.MaxProfileSeconds)
+	assert.Equal(t, 100, config.Pprof.MutexProfileFraction)
+	assert.Equal(t, 0, config.Pprof.BlockProfileRate)
+	assert.True(t, config.TLS.Enabled())
+	assert.Equal(t, "/etc/tls/server.crt", config.TLS.Cert)
+	assert.Equal(t, "/etc/tls/server.key", config.TLS.Key)
+	assert.Equal(t, "/etc/tls/ca.crt", config.TLS.ClientCA)
+	version, err := config.TLS.Version()
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+	assert.Equal(t, 60, config.AvailabilityCacheTTL)
+	assert.Equal(t, "s3cret", config.CursorSecret)
+	assert.Equal(t, 100, config.AvailabilityCacheSize)
+	assert.Equal(t, 500, config.AvailabilityTimeout)
+	assert.Equal(t, 600, config.ProjectsRefreshInterval)
+	assert.False(t, config.Compression.Enabled)
+	assert.Equal(t, 256, config.Compression.MinSize)
+	assert.Equal(t, 60, config.CacheControl.NotFoundMaxAge)
+	assert.True(t, config.ResponseCache.Enabled)
+	assert.Equal(t, 100, config.ResponseCache.Size)
+	assert.Equal(t, 60, config.ResponseCache.TTL)
+	assert.True(t, config.RateLimit.Enabled)
+	assert.Equal(t, 2.5, config.RateLimit.Rate)
+	assert.Equal(t, 5, config.RateLimit.Burst)
+	assert.Equal(t, "X-Client-ID", config.RateLimit.ClientHeader)
+	assert.Equal(t, []string{"10.1.2.3"}, config.RateLimit.TrustedProxies)
+	assert.Equal(t, []string{"10.0.0.0/8", "127.0.0.1"}, config.RateLimit.AllowedIPs)
+	assert.Equal(t, []string{"internal"}, config.RateLimit.AllowedClients)
+	assert.True(t, config.RangeLimits.Paginate)
+	assert.Equal(t, 720, config.RangeLimits.Limit("all-sites", "hourly"))
+	assert.Equal(t, 1100, config.RangeLimits.Limit("all-sites", "daily"))
+	assert.Equal(t, 168, config.RangeLimits.Limit("mobile-site", "hourly"))
+	assert.Equal(t, 0, config.RangeLimits.Limit("mobile-site", "monthly"))
+	assert.True(t, config.CORS.Enabled)
+	assert.Equal(t, []string{"https://dashboards.example.org"}, config.CORS.AllowedOrigins)
+	assert.Equal(t, []string{"GET", "OPTIONS"}, config.CORS.AllowedMethods)
+	assert.Equal(t, []string{"Accept"}, config.CORS.AllowedHeaders)
+	assert.Equal(t, 600, config.CORS.MaxAge)
+	assert.Equal(t, "", config.SecurityHeaders.ContentSecurityPolicy)
+	assert.Equal(t, "deny", config.SecurityHeaders.FrameOptions)
+	assert.Equal(t, "cross-origin", config.SecurityHeaders.CrossOriginResourcePolicy)
+	assert.Equal(t, 600, config.SecurityHeaders.HSTSMaxAge)
+	assert.True(t, config.SecurityHeaders.HSTSIncludeSubdomains)
+	assert.Equal(t, 86400, config.CacheControl.Policy("daily").PastMaxAge)
+	assert.Equal(t, 600, config.CacheControl.Policy("daily").CurrentMaxAge)
+	assert.Equal(t, 31536000, config.CacheControl.Policy("monthly").PastMaxAge)
 	assert.Equal(t, 9043, config.Cassandra.Port)
 	assert.Equal(t, "localquorum", strings.ToLower(config.Cassandra.Consistency))
 	assert.Len(t, config.Cassandra.Hosts, 2)
 	assert.Contains(t, config.Cassandra.Hosts, "127.0.0.6")
 	assert.Contains(t, config.Cassandra.Hosts, "127.0.0.7")
 	assert.Equal(t, "datacenter1", config.Cassandra.LocalDC)
+	assert.Equal(t, 2, config.Cassandra.SpeculativeExecution.Attempts)
+	assert.Equal(t, 5, config.Cassandra.SpeculativeExecution.Delay)
+	assert.Equal(t, 3, config.Cassandra.Retry.NumRetries)
+	assert.Equal(t, 2, config.Cassandra.Retry.MinBackoff)
+	assert.Equal(t, 20, config.Cassandra.Retry.MaxBackoff)
+	assert.True(t, config.Cassandra.CircuitBreaker.Enabled)
+	assert.Equal(t, 30, config.Cassandra.CircuitBreaker.Window)
+	assert.Equal(t, 5, config.Cassandra.CircuitBreaker.MinRequests)
+	assert.Equal(t, 0.25, config.Cassandra.CircuitBreaker.ErrorRate)
+	assert.Equal(t, 10, config.Cassandra.CircuitBreaker.OpenDuration)
+	assert.True(t, config.Cassandra.CircuitBreaker.ServeStale)
 }
 
 func TestValidConsistencies(t *testing.T) {
@@ -109,3 +305,145 @@ func TestBogusLogLevel(t *testing.T) {
 	_, err := configuration.NewConfig([]byte("log_level: unreal"))
 	require.Error(t, err)
 }
+
+func TestBogusProjectsRefreshInterval(t *testing.T) {
+	_, err := configuration.NewConfig([]byte("projects_refresh_interval: 0"))
+	require.Error(t, err)
+}
+
+func TestBogusAvailabilityCache(t *testing.T) {
+	for _, conf := range []string{"availability_cache_size: 0", "availability_timeout: 0"} {
+		_, err := configuration.NewConfig([]byte(conf))
+		require.Error(t, err)
+	}
+}
+
+func TestBogusResponseCacheSize(t *testing.T) {
+	_, err := configuration.NewConfig([]byte("response_cache:\n    size: 0"))
+	require.Error(t, err)
+
+	_, err = configuration.NewConfig([]byte("response_cache:\n    enabled: false\n    size: 0"))
+	require.NoError(t, err)
+}
+
+func TestBogusRateLimit(t *testing.T) {
+	var confs = []string{
+		"rate_limit:\n    enabled: true\n    rate: 0",
+		"rate_limit:\n    enabled: true\n    burst: 0",
+		"rate_limit:\n    enabled: true\n    allowed_ips: [not-an-address]",
+		"rate_limit:\n    enabled: true\n    client_header: X-Client-ID",
+		"rate_limit:\n    enabled: true\n    client_header: X-Client-ID\n    trusted_proxies: [not-an-address]",
+	}
+	for _, conf := range confs {
+		_, err := configuration.NewConfig([]byte(conf))
+		require.Error(t, err)
+	}
+}
+
+func TestBogusRangeLimits(t *testing.T) {
+	var confs = []string{
+		"range_limits:\n    daily: -1",
+		"range_limits:\n    access_sites:\n        all-sites:\n            monthly: -1",
+	}
+	for _, conf := range confs {
+		_, err := configuration.NewConfig([]byte(conf))
+		require.Error(t, err)
+	}
+}
+
+func TestBogusCORS(t *testing.T) {
+	var confs = []string{
+		"cors:\n    enabled: true\n    allowed_origins: []",
+		"cors:\n    enabled: true\n    max_age: -1",
+	}
+	for _, conf := range confs {
+		_, err := configuration.NewConfig([]byte(conf))
+		require.Error(t, err)
+	}
+}
+
+func TestBogusTLS(t *testing.T) {
+	var confs = []string{
+		"tls:\n    cert: /etc/tls/server.crt",
+		"tls:\n    key: /etc/tls/server.key",
+		"tls:\n    client_ca: /etc/tls/ca.crt",
+		"tls:\n    min_version: \"1.4\"",
+		"tls:\n    cert: /etc/tls/server.crt\n    key: /etc/tls/server.key\n    reload_interval: 0",
+	}
+	for _, conf := range confs {
+		_, err := configuration.NewConfig([]byte(conf))
+		require.Error(t, err)
+	}
+}
+
+func TestBogusAdminListener(t *testing.T) {
+	_, err := configuration.NewConfig([]byte("admin:\n    listen_port: 8080"))
+	require.Error(t, err)
+}
+
+func TestBogusPprof(t *testing.T) {
+	var confs = []string{
+		"pprof:\n    enabled: true",
+		"admin:\n    listen_port: 9090\npprof:\n    enabled: true\n    max_profile_seconds: 0",
+	}
+	for _, conf := range confs {
+		_, err := configuration.NewConfig([]byte(conf))
+		require.Error(t, err)
+	}
+}
+
+func TestSocketListenAddresses(t *testing.T) {
+	config, err := configuration.NewConfig([]byte("listen_address: unix:/run/device-analytics.sock\nsocket_mode: \"0600\"\nadmin:\n    listen_address: systemd:1"))
+	require.NoError(t, err)
+	assert.Equal(t, "unix:/run/device-analytics.sock", config.ListenAddress())
+	assert.Equal(t, os.FileMode(0600), config.SocketFileMode())
+	assert.True(t, config.Admin.Enabled())
+	assert.Equal(t, "systemd:1", config.Admin.ListenAddress())
+}
+
+func TestBogusSocketMode(t *testing.T) {
+	for _, mode := range []string{"rw", "0999", "01777"} {
+		_, err := configuration.NewConfig([]byte("socket_mode: \"" + mode + "\""))
+		require.Error(t, err)
+	}
+}
+
+func TestBogusServer(t *testing.T) {
+	var confs = []string{
+		"server:\n    read_timeout: -1",
+		"server:\n    concurrency: -1",
+		"stream_timeout: 30000\nserver:\n    write_timeout: 10000",
+	}
+	for _, conf := range confs {
+		_, err := configuration.NewConfig([]byte(conf))
+		require.Error(t, err)
+	}
+}
+
+func TestBogusQueryPolicies(t *testing.T) {
+	var confs = []string{
+		"cassandra:\n    speculative_execution:\n        attempts: -1",
+		"cassandra:\n    speculative_execution:\n        attempts: 1\n        delay: 0",
+		"cassandra:\n    retry:\n        num_retries: 1\n        min_backoff: 0",
+		"cassandra:\n    retry:\n        num_retries: 1\n        min_backoff: 20\n        max_backoff: 10",
+	}
+	for _, conf := range confs {
+		_, err := configuration.NewConfig([]byte(conf))
+		require.Error(t, err)
+	}
+}
+
+func TestBogusCircuitBreaker(t *testing.T) {
+	var confs = []string{
+		"cassandra:\n    circuit_breaker:\n        enabled: true\n        window: 0",
+		"cassandra:\n    circuit_breaker:\n        enabled: true\n        min_requests: 0",
+		"cassandra:\n    circuit_breaker:\n        enabled: true\n        error_rate: 0",
+		"cassandra:\n    circuit_breaker:\n        enabled: true\n        error_rate: 1.5",
+		"cassandra:\n    circuit_breaker:\n        enabled: true\n        open_duration: 0",
+		"response_cache:\n    enabled: false\ncassandra:\n    circuit_breaker:\n        enabled: true\n        serve_stale: true",
+	}
+	for _, conf := range confs {
+		_, err := configuration.NewConfig([]byte(conf))
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"device-analytics/listener"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenTCP(t *testing.T) {
+	ln, err := listener.Listen("127.0.0.1:0", 0660)
+	require.NoError(t, err)
+	defer ln.Close()
+	assert.Equal(t, "tcp", ln.Addr().Network())
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.sock")
+
+	ln, err := listener.Listen("unix:"+path, 0600)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeSocket, "Not a socket")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+
+	require.NoError(t, ln.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "Socket not removed on close")
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.sock")
+
+	// A socket left behind by a process that did not shut down cleanly
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listener.Listen("unix:"+path, 0660)
+	require.NoError(t, err)
+	ln.Close()
+}
+
+func TestListenUnixRefusesToReplaceFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "not-a-socket")
+	require.NoError(t, ioutil.WriteFile(path, []byte("data"), 0600))
+
+	_, err = listener.Listen("unix:"+path, 0660)
+	require.Error(t, err)
+	_, err = os.Stat(path)
+	assert.NoError(t, err, "File was removed")
+}
+
+func TestListenSystemdWithoutSockets(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	for _, address := range []string{"systemd", "systemd:1", "systemd:bogus"} {
+		_, err := listener.Listen(address, 0660)
+		require.Error(t, err, address)
+	}
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"testing"
+
+	"device-analytics/entities"
+	"device-analytics/logic"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeriodDuration(t *testing.T) {
+	assert.Equal(t, "PT1H", logic.PeriodDuration("hourly"))
+	assert.Equal(t, "P1D", logic.PeriodDuration("daily"))
+	assert.Equal(t, "P1M", logic.PeriodDuration("monthly"))
+}
+
+func TestDailyTimeMetadata(t *testing.T) {
+	response := entities.UniqueDevicesResponse{Items: []entities.UniqueDevices{
+		{Timestamp: "20220131"},
+		{Timestamp: "20220201"},
+	}}
+	require.NoError(t, logic.AddTimeMetadata(&response, "daily", "2022013100", "2022020100"))
+
+	assert.Equal(t, "P1D", response.Period)
+	assert.Equal(t, "2022-01-31T00:00:00Z", response.Items[0].PeriodStart)
+	assert.Equal(t, "2022-02-01T00:00:00Z", response.Items[0].PeriodEnd)
+	assert.Equal(t, "2022-02-01T00:00:00Z", response.Items[1].PeriodStart)
+	assert.Equal(t, "2022-02-02T00:00:00Z", response.Items[1].PeriodEnd)
+
+	require.NotNil(t, response.Range)
+	assert.Equal(t, "2022013100", response.Range.Start)
+	assert.Equal(t, "2022020100", response.Range.End)
+	assert.Equal(t, "2022-01-31T00:00:00Z", response.Range.StartTime)
+	assert.Equal(t, "2022-02-02T00:00:00Z", response.Range.EndTime)
+}
+
+func TestMonthlyTimeMetadata(t *testing.T) {
+	response := entities.UniqueDevicesResponse{Items: []entities.UniqueDevices{
+		{Timestamp: "20220101"},
+	}}
+	require.NoError(t, logic.AddTimeMetadata(&response, "monthly", "2022010100", "2022013100"))
+
+	assert.Equal(t, "P1M", response.Period)
+	assert.Equal(t, "2022-01-01T00:00:00Z", response.Items[0].PeriodStart)
+	assert.Equal(t, "2022-02-01T00:00:00Z", response.Items[0].PeriodEnd)
+	assert.Equal(t, "2022-02-01T00:00:00Z", response.Range.EndTime)
+}
+
+func TestInvalidTimeMetadata(t *testing.T) {
+	response := entities.UniqueDevicesResponse{Items: []entities.UniqueDevices{
+		{Timestamp: "2022"},
+	}}
+	require.Error(t, logic.AddTimeMetadata(&response, "daily", "2022010100", "2022013100"))
+}
+
+func TestPeriodCount(t *testing.T) {
+	var ranges = []struct {
+		start, end, granularity string
+		expected                int
+	}{
+		{"2022010100", "2022010100", "daily", 1},
+		{"2022010100", "2022013100", "daily", 31},
+		{"2020010100", "2020123100", "daily", 366},
+		{"2022011500", "2022021500", "monthly", 2},
+		{"2021120100", "2022113000", "monthly", 12},
+		{"2022010100", "2022010123", "hourly", 24},
+	}
+	for _, r := range ranges {
+		count, err := logic.PeriodCount(r.start, r.end, r.granularity)
+		require.NoError(t, err)
+		assert.Equal(t, r.expected, count, "%s %s-%s", r.granularity, r.start, r.end)
+	}
+}
+
+func TestTruncateRange(t *testing.T) {
+	end, next, err := logic.TruncateRange("2022010100", 31, "daily")
+	require.NoError(t, err)
+	assert.Equal(t, "2022013100", end)
+	assert.Equal(t, "2022020100", next)
+
+	end, next, err = logic.TruncateRange("2022011500", 2, "monthly")
+	require.NoError(t, err)
+	assert.Equal(t, "2022022800", end)
+	assert.Equal(t, "2022030100", next)
+
+	end, next, err = logic.TruncateRange("2022010100", 24, "hourly")
+	require.NoError(t, err)
+	assert.Equal(t, "2022010123", end)
+	assert.Equal(t, "2022010200", next)
+}
@@ -0,0 +1,17 @@
+package test
+
+import (
+	"testing"
+
+	"device-analytics/logic"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProjectDomain(t *testing.T) {
+	assert.Equal(t, "en.wikipedia.org", logic.ProjectDomain("en.wikipedia"))
+	assert.Equal(t, "commons.wikimedia.org", logic.ProjectDomain("commons.wikimedia"))
+	assert.Equal(t, "www.wikidata.org", logic.ProjectDomain("wikidata"))
+	assert.Equal(t, "www.mediawiki.org", logic.ProjectDomain("mediawiki"))
+	assert.Equal(t, "de.wikipedia.org", logic.ProjectDomain("DE.Wikipedia"))
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"device-analytics/logic"
+
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+)
+
+// retryableQuery is a gocql.RetryableQuery that has been attempted a number of times.
+type retryableQuery struct {
+	attempts int
+	context  context.Context
+}
+
+func (q *retryableQuery) Attempts() int                      { return q.attempts }
+func (q *retryableQuery) SetConsistency(c gocql.Consistency) {}
+func (q *retryableQuery) GetConsistency() gocql.Consistency  { return gocql.One }
+func (q *retryableQuery) Context() context.Context           { return q.context }
+
+func TestBackoffRetryPolicyRetries(t *testing.T) {
+	policy := &logic.BackoffRetryPolicy{NumRetries: 2, Min: time.Millisecond, Max: 2 * time.Millisecond}
+
+	assert.True(t, policy.Attempt(&retryableQuery{attempts: 1, context: context.Background()}))
+	assert.True(t, policy.Attempt(&retryableQuery{attempts: 2, context: context.Background()}))
+	assert.False(t, policy.Attempt(&retryableQuery{attempts: 3, context: context.Background()}), "Retried too often")
+
+	assert.Equal(t, gocql.RetryNextHost, policy.GetRetryType(errors.New("timeout")))
+	assert.Equal(t, gocql.Rethrow, policy.GetRetryType(context.DeadlineExceeded))
+}
+
+func TestBackoffRetryPolicyRespectsDeadline(t *testing.T) {
+	policy := &logic.BackoffRetryPolicy{NumRetries: 2, Min: 50 * time.Millisecond, Max: time.Second}
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.False(t, policy.Attempt(&retryableQuery{attempts: 1, context: c}), "Retried past the deadline")
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Millisecond), "Waited for a retry that could not be made")
+}
+
+func TestBackoffRetryPolicyStopsWhenCanceled(t *testing.T) {
+	policy := &logic.BackoffRetryPolicy{NumRetries: 2, Min: time.Second, Max: time.Second}
+
+	c, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	assert.False(t, policy.Attempt(&retryableQuery{attempts: 1, context: c}))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestBreakerCounts(t *testing.T) {
+	server, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-server.Done()
+	client, cancel := context.WithTimeout(logic.WithClientDeadline(context.Background()), time.Nanosecond)
+	defer cancel()
+	<-client.Done()
+
+	assert.True(t, logic.BreakerCounts(context.Background(), nil))
+	assert.True(t, logic.BreakerCounts(context.Background(), errors.New("unavailable")))
+	assert.False(t, logic.BreakerCounts(context.Background(), context.Canceled))
+
+	// Running out of the server's timeout is a failure, but not of the client's deadline
+	assert.True(t, logic.BreakerCounts(server, context.DeadlineExceeded))
+	assert.False(t, logic.BreakerCounts(client, context.DeadlineExceeded))
+	assert.False(t, logic.BreakerCounts(client, gocql.ErrTimeoutNoResponse))
+	assert.True(t, logic.BreakerCounts(logic.WithClientDeadline(context.Background()), errors.New("unavailable")))
+}
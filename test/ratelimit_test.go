@@ -0,0 +1,46 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"device-analytics/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitBurst(t *testing.T) {
+	limiter := ratelimit.New(1, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		result := limiter.Allow("client", now)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 3, result.Limit)
+		assert.Equal(t, 2-i, result.Remaining)
+	}
+
+	result := limiter.Allow("client", now)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, time.Second, result.RetryAfter)
+	assert.Equal(t, 3*time.Second, result.Reset)
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	limiter := ratelimit.New(2, 1)
+	now := time.Now()
+
+	assert.True(t, limiter.Allow("client", now).Allowed)
+	assert.False(t, limiter.Allow("client", now.Add(100*time.Millisecond)).Allowed)
+	assert.True(t, limiter.Allow("client", now.Add(500*time.Millisecond)).Allowed)
+}
+
+func TestRateLimitPerClient(t *testing.T) {
+	limiter := ratelimit.New(1, 1)
+	now := time.Now()
+
+	assert.True(t, limiter.Allow("a", now).Allowed)
+	assert.False(t, limiter.Allow("a", now).Allowed)
+	assert.True(t, limiter.Allow("b", now).Allowed)
+}
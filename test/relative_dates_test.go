@@ -0,0 +1,68 @@
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"device-analytics/logic"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var now = time.Date(2022, time.March, 31, 23, 30, 0, 0, time.UTC)
+
+func latest() (string, error) {
+	return "20220330", nil
+}
+
+func TestRelativeDates(t *testing.T) {
+	var expressions = map[string]string{
+		"today":     "20220331",
+		"TODAY":     "20220331",
+		"yesterday": "20220330",
+		"latest":    "20220330",
+		"-0d":       "20220331",
+		"-30d":      "20220301",
+		"-1m":       "20220228",
+		"-25m":      "20200229",
+		"-12m":      "20210331",
+		"-1y":       "20210331",
+	}
+	for expr, expected := range expressions {
+		t.Run(expr, func(t *testing.T) {
+			timestamp, relative, err := logic.ResolveTimestamp(expr, now, latest)
+			require.NoError(t, err)
+			assert.True(t, relative)
+			assert.Equal(t, expected, timestamp)
+		})
+	}
+}
+
+func TestRelativeDatesUseUTC(t *testing.T) {
+	local := now.In(time.FixedZone("UTC+2", 2*60*60))
+	timestamp, _, err := logic.ResolveTimestamp("today", local, latest)
+	require.NoError(t, err)
+	assert.Equal(t, "20220331", timestamp)
+}
+
+func TestAbsoluteDates(t *testing.T) {
+	for _, expr := range []string{"20220101", "2022010100", "30d", "-d", "tomorrow"} {
+		t.Run(expr, func(t *testing.T) {
+			timestamp, relative, err := logic.ResolveTimestamp(expr, now, latest)
+			require.NoError(t, err)
+			assert.False(t, relative)
+			assert.Equal(t, expr, timestamp)
+		})
+	}
+}
+
+func TestLatestWithoutData(t *testing.T) {
+	_, _, err := logic.ResolveTimestamp("latest", now, func() (string, error) { return "", nil })
+	assert.Equal(t, logic.ErrNoLatest, err)
+
+	failure := errors.New("query failed")
+	_, _, err = logic.ResolveTimestamp("latest", now, func() (string, error) { return "", failure })
+	assert.Equal(t, failure, err)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"device-analytics/certreload"
+	"device-analytics/configuration"
+)
+
+// newTLSConfig returns the TLS configuration of the service, serving the certificate of
+// reloader, and verifying client certificates if a client CA is configured.
+func newTLSConfig(config *configuration.Config, reloader *certreload.Reloader) (*tls.Config, error) {
+	minVersion, err := config.TLS.Version()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.TLS.ClientCA != "" {
+		pem, err := ioutil.ReadFile(config.TLS.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in client CA file %s", config.TLS.ClientCA)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"device-analytics/configuration"
+	"device-analytics/entities"
 	"device-analytics/logic"
 
 	"gerrit.wikimedia.org/r/mediawiki/services/servicelib-golang/logger"
 	"github.com/gocql/gocql"
 	"github.com/valyala/fasthttp"
 	"gitlab.wikimedia.org/frankie/aqsassist"
+	"schneider.vip/problem"
 )
 
 // UniqueDevicesHandler is the HTTP handler for unique-devices endpoint requests.
@@ -22,19 +26,31 @@ type UniqueDevicesHandler struct {
 	session *gocql.Session
 	logic   *logic.UniqueDevicesLogic
 	config  *configuration.Config
+	cursors *cursorSigner
 }
 
 // API documentation
 // @summary      Get unique devices per project
 // @router       /unique-devices/{project}/{access-site}/{granularity}/{start}/{end}  [get]
 // @description  Given a Wikimedia project and a date range, returns the number of unique devices that visited that wiki.
+// @description  Relative dates are resolved in UTC, and the resolved range is included in the response.
+// @description  Newline-delimited JSON responses are streamed one row per line; an error after the first row is signalled by a final line containing an `error` object.
+// @description  Ranges longer than the configured limit for the granularity are rejected, or, if pagination is enabled, cut short with the URL of the rest of the range in `next` and a Link header.
 // @param        project      path  string  true  "Domain of a Wikimedia project"              example(en.wikipedia.org)
 // @param        access-site  path  string  true  "Method of access"                           example(all-sites)  Enums(all-sites, desktop-site, mobile-site)
 // @param        granularity  path  string  true  "Time unit for response data"                example(daily)  Enums(daily, monthly)
-// @param        start        path  string  true  "First date to include, in YYYYMMDD format"  example(20220101)
-// @param        end          path  string  true  "Last date to include, in YYYYMMDD format"   example(20220108)
+// @param        start        path  string  true  "First date to include, in YYYYMMDD format, or a relative date (today, yesterday, latest, -30d, -12m)"  example(20220101)
+// @param        end          path  string  true  "Last date to include, in YYYYMMDD format, or a relative date (today, yesterday, latest, -30d, -12m)"   example(20220108)
+// @param        time_format  query string  false "Set to iso8601 to include RFC 3339 period bounds for each row, the period duration and the requested range"  Enums(iso8601)
+// @param        format       query string  false "Response format, overriding the Accept header"  Enums(json, csv, tsv, ndjson)
+// @param        limit        query int     false "Maximum number of rows per page (1 to 1000, 100 by default when a cursor is given); the next page is linked by next and a Link header"
+// @param        cursor       query string  false "Opaque cursor of the next page, as given in a next link"
 // @produce      json
+// @produce      text/csv
+// @produce      text/tab-separated-values
+// @produce      application/x-ndjson
 // @success      200  {object}  entities.UniqueDevicesResponse
+// @success      304
 func (s *UniqueDevicesHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
 	var err error
 
@@ -50,19 +66,37 @@ func (s *UniqueDevicesHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	if start, err = aqsassist.ValidateTimestamp(ctx.UserValue("start").(string)); err != nil {
-		problemResp := aqsassist.CreateProblem(http.StatusBadRequest, "start timestamp is invalid, must be a valid date in YYYYMMDD format", string(ctx.Request.URI().RequestURI())).JSON()
+	format, ok := negotiateFormat(ctx)
+	if !ok {
+		problemResp := aqsassist.CreateProblem(http.StatusBadRequest, invalidFormatDetail, string(ctx.Request.URI().RequestURI())).JSON()
 		ctx.SetStatusCode(http.StatusBadRequest)
 		ctx.SetBody(problemResp)
 		return
 	}
-	if end, err = aqsassist.ValidateTimestamp(ctx.UserValue("end").(string)); err != nil {
-		problemResp := aqsassist.CreateProblem(http.StatusBadRequest, "end timestamp is invalid, must be a valid date in YYYYMMDD format", string(ctx.Request.URI().RequestURI())).JSON()
+
+	limit, cursor, pbm := pageParams(ctx)
+	if pbm != nil {
+		return
+	}
+	if limit > 0 && format == formatNDJSON {
+		problemResp := aqsassist.CreateProblem(http.StatusBadRequest, "limit and cursor are not supported for ndjson, which is streamed in full", string(ctx.Request.URI().RequestURI())).JSON()
 		ctx.SetStatusCode(http.StatusBadRequest)
 		ctx.SetBody(problemResp)
 		return
 	}
 
+	c, cancel := requestContext(ctx, ctx, s.config, time.Duration(s.config.ContextTimeout)*time.Millisecond)
+	defer cancel()
+
+	// Relative expressions (e.g. -30d or latest) are resolved to absolute timestamps first
+	var startRelative, endRelative bool
+	if start, startRelative, pbm = s.resolveTimestamp(c, ctx, "start", project, accessSite, granularity); pbm != nil {
+		return
+	}
+	if end, endRelative, pbm = s.resolveTimestamp(c, ctx, "end", project, accessSite, granularity); pbm != nil {
+		return
+	}
+
 	if err = aqsassist.StartBeforeEnd(start, end); err != nil {
 		problemResp := aqsassist.CreateProblem(http.StatusBadRequest, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
 		ctx.SetStatusCode(http.StatusBadRequest)
@@ -70,16 +104,83 @@ func (s *UniqueDevicesHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	c, _ := context.WithTimeout(ctx, time.Duration(s.config.ContextTimeout)*time.Millisecond)
-	pbm, response := s.logic.ProcessUniqueDevicesLogic(c, ctx, project, accessSite, granularity, start, end, s.session, s.logger)
+	// Ranges longer than the configured limit are rejected, or cut short with a link to the rest
+	var next string
+	rangeEnd := end
+	if end, next, pbm = s.limitRange(ctx, accessSite, granularity, start, end); pbm != nil {
+		return
+	}
+
+	if format == formatNDJSON {
+		setLinkNext(ctx, next)
+		s.stream(ctx, project, accessSite, granularity, start, end)
+		return
+	}
+
+	var response entities.UniqueDevicesResponse
+	if limit > 0 {
+		var pageState []byte
+		if cursor != nil {
+			var ok bool
+			if pageState, ok = s.cursors.open(cursor, project, accessSite, granularity, start, end); !ok {
+				setPageProblem(ctx, invalidCursorDetail)
+				return
+			}
+		}
+		// Within a range, a cursor for the next page takes precedence over the next range
+		if pbm, response, pageState = s.logic.ProcessUniqueDevicesPageLogic(c, ctx, project, accessSite, granularity, start, end, limit, pageState, s.session, s.logger); len(pageState) > 0 {
+			next = pageURI(ctx, start, rangeEnd, s.cursors.sign(pageState, project, accessSite, granularity, start, end))
+		}
+	} else {
+		pbm, response = s.logic.ProcessUniqueDevicesLogic(c, ctx, project, accessSite, granularity, start, end, s.session, s.logger)
+	}
+	if pbm != nil && next != "" && ctx.Response.StatusCode() == http.StatusNotFound {
+		// A page without data is not the end of the results
+		pbm, response = nil, entities.UniqueDevicesResponse{Items: []entities.UniqueDevices{}}
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	}
 	if pbm != nil {
+		if ctx.Response.StatusCode() == http.StatusNotFound {
+			setNotFoundCacheControl(ctx, s.config)
+		}
 		problemResp, _ := json.Marshal(pbm)
 		ctx.SetBody(problemResp)
 		return
 	}
+	response.Next = next
+	setLinkNext(ctx, next)
+
+	if startRelative || endRelative {
+		response.Range = &entities.Range{Start: start, End: end}
+	}
+	if isoTimeFormat(ctx) {
+		if err = logic.AddTimeMetadata(&response, granularity, start, end); err != nil {
+			s.logger.Log(logger.ERROR, "Unable to add time metadata: %s", err)
+			problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			ctx.SetBody(problemResp)
+			return
+		}
+	}
+
+	setLastModified(ctx, response.Items)
+	setCacheControl(ctx, s.config, granularity, end, startRelative || endRelative, response.Items)
+
+	if format == formatCSV || format == formatTSV {
+		if err = writeDelimited(ctx, format, response, "unique-devices", project, accessSite, granularity, start+"-"+end); err != nil {
+			s.logger.Log(logger.ERROR, "Unable to write %s response: %s", format, err)
+			problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
+			ctx.ResetBody()
+			ctx.SetContentType("application/json; charset=utf-8")
+			ctx.Response.Header.Del("Content-Disposition")
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			ctx.SetBody(problemResp)
+		}
+		return
+	}
 
 	var data []byte
-	if data, err = json.MarshalIndent(response, "", " "); err != nil {
+	if data, err = marshalJSON(ctx, response); err != nil {
 		s.logger.Log(logger.ERROR, "Unable to marshal response object: %s", err)
 		problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, err.Error(), string(ctx.Request.URI().RequestURI())).JSON()
 		ctx.SetStatusCode(http.StatusInternalServerError)
@@ -90,3 +191,150 @@ func (s *UniqueDevicesHandler) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	ctx.SetBody([]byte(data))
 }
+
+// limitRange applies the configured range limit for an access site and granularity. It
+// returns the end of the range to query, and if the range was cut short to the limit (see
+// RangeLimits.Paginate), the URI of the next page. If the range is too long and pagination
+// is disabled, or can't be measured against the limit, the problem is set on the response
+// and returned.
+func (s *UniqueDevicesHandler) limitRange(ctx *fasthttp.RequestCtx, accessSite, granularity, start, end string) (string, string, *problem.Problem) {
+	limit := s.config.RangeLimits.Limit(accessSite, granularity)
+	if limit == 0 {
+		return end, "", nil
+	}
+	periods, err := logic.PeriodCount(start, end, granularity)
+	if err != nil {
+		return end, "", s.rangeProblem(ctx, limit, granularity, accessSite, err)
+	}
+	if periods <= limit {
+		return end, "", nil
+	}
+
+	if !s.config.RangeLimits.Paginate {
+		detail := fmt.Sprintf("The requested range spans %d %s periods, more than the limit of %d for %s; please request a shorter range", periods, granularity, limit, accessSite)
+		problemResp := aqsassist.CreateProblem(http.StatusBadRequest, detail, string(ctx.Request.URI().RequestURI()))
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetBody(problemResp.JSON())
+		return end, "", problemResp
+	}
+
+	pageEnd, nextStart, err := logic.TruncateRange(start, limit, granularity)
+	if err != nil {
+		return end, "", s.rangeProblem(ctx, limit, granularity, accessSite, err)
+	}
+	return pageEnd, pageURI(ctx, nextStart, end, nil), nil
+}
+
+// rangeProblem sets and returns the problem for a range that could not be measured against
+// its limit, so that the limit is never silently skipped.
+func (s *UniqueDevicesHandler) rangeProblem(ctx *fasthttp.RequestCtx, limit int, granularity, accessSite string, err error) *problem.Problem {
+	s.logger.Log(logger.WARNING, "Unable to apply range limit: %s", err)
+	detail := fmt.Sprintf("The requested range could not be checked against the limit of %d %s periods for %s; please check the start and end timestamps", limit, granularity, accessSite)
+	problemResp := aqsassist.CreateProblem(http.StatusBadRequest, detail, string(ctx.Request.URI().RequestURI()))
+	ctx.SetStatusCode(http.StatusBadRequest)
+	ctx.SetBody(problemResp.JSON())
+	return problemResp
+}
+
+// stream writes the rows in a range to the body as newline-delimited JSON, as they are
+// read from Cassandra, so that large ranges are never held in memory. Once the first row
+// has been written the status can no longer change, so later errors are signalled with a
+// final line containing an error object.
+func (s *UniqueDevicesHandler) stream(ctx *fasthttp.RequestCtx, project, accessSite, granularity, start, end string) {
+	// The stream outlives this handler, so it can't use the request context
+	c, cancel := requestContext(context.Background(), ctx, s.config, time.Duration(s.config.StreamTimeout)*time.Millisecond)
+	stream := s.logic.StreamUniqueDevices(c, project, accessSite, granularity, start, end, s.session)
+	uri := string(ctx.Request.URI().RequestURI())
+
+	first, ok := stream.Next()
+	if !ok {
+		defer cancel()
+		if err := stream.Err(); err != nil {
+			logic.QueryProblem(ctx, err, s.logger)
+			return
+		}
+		problemResp := aqsassist.CreateProblem(http.StatusNotFound, logic.NotFoundDetail, uri).JSON()
+		setNotFoundCacheControl(ctx, s.config)
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetBody(problemResp)
+		return
+	}
+
+	iso := isoTimeFormat(ctx)
+	setCurrentCacheControl(ctx, s.config, granularity)
+	ctx.SetContentType(formatContentTypes[formatNDJSON])
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		encoder := json.NewEncoder(w)
+
+		for item, ok := first, true; ok; item, ok = stream.Next() {
+			if iso {
+				if periodStart, periodEnd, err := logic.PeriodBounds(item.Timestamp, granularity); err == nil {
+					item.PeriodStart = periodStart.Format(time.RFC3339)
+					item.PeriodEnd = periodEnd.Format(time.RFC3339)
+				}
+			}
+			if err := encoder.Encode(item); err != nil {
+				s.logger.Log(logger.WARNING, "Unable to write streamed response: %s", err)
+				return
+			}
+		}
+
+		if err := stream.Err(); err != nil {
+			s.logger.Log(logger.ERROR, "Query failed mid-stream: %s", err)
+			problemResp := aqsassist.CreateProblem(http.StatusInternalServerError, logic.QueryFailedDetail, uri).JSON()
+			_ = encoder.Encode(map[string]json.RawMessage{"error": problemResp})
+		}
+	})
+}
+
+// resolveTimestamp resolves the start or end path parameter, which may be a relative
+// expression, to a validated absolute timestamp. The boolean result reports whether the
+// parameter was a relative expression. On failure, the problem is set on the response and
+// returned.
+func (s *UniqueDevicesHandler) resolveTimestamp(c context.Context, ctx *fasthttp.RequestCtx, name, project, accessSite, granularity string) (string, bool, *problem.Problem) {
+	var queryErr error
+	latest := func() (string, error) {
+		timestamp, err := s.logic.LatestTimestamp(c, project, accessSite, granularity, s.session)
+		if err != nil {
+			queryErr = err
+		}
+		return timestamp, err
+	}
+
+	timestamp, relative, err := logic.ResolveTimestamp(ctx.UserValue(name).(string), time.Now(), latest)
+	if err == nil {
+		timestamp, err = aqsassist.ValidateTimestamp(timestamp)
+	}
+	if err == nil {
+		return timestamp, relative, nil
+	}
+
+	if queryErr != nil {
+		return "", relative, logic.QueryProblem(ctx, queryErr, s.logger)
+	}
+
+	status := http.StatusBadRequest
+	detail := name + " timestamp is invalid, must be a valid date in YYYYMMDD format, or one of today, yesterday, latest, -<n>d, -<n>m or -<n>y"
+	if err == logic.ErrNoLatest {
+		status = http.StatusNotFound
+		detail = "We do not have data to resolve latest for the project you asked for.  Please check documentation for more information."
+	}
+
+	problemResp := aqsassist.CreateProblem(status, detail, string(ctx.Request.URI().RequestURI()))
+	ctx.SetStatusCode(status)
+	ctx.SetBody(problemResp.JSON())
+	return "", relative, problemResp
+}
+
+// isoTimeFormat reports whether a request opted in to RFC 3339 time metadata, either with
+// the time_format=iso8601 query parameter, or with an iso8601 profile in the Accept header
+// (e.g. application/json; profile="iso8601").
+func isoTimeFormat(ctx *fasthttp.RequestCtx) bool {
+	if strings.EqualFold(string(ctx.QueryArgs().Peek("time_format")), "iso8601") {
+		return true
+	}
+	accept := strings.ToLower(string(ctx.Request.Header.Peek("Accept")))
+	return strings.Contains(accept, `profile="iso8601"`) || strings.Contains(accept, "profile=iso8601")
+}